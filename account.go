@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/logging"
+)
+
+// handlerUsersMeDelete deletes the authenticated user and everything they own
+// after checking their password
+func (a *apiConfig) handlerUsersMeDelete(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password is required")
+		return
+	}
+
+	if !a.passwordMatches(r.Context(), user, params.Password) {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+
+	err = a.db.DeleteUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't delete user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+type accountExport struct {
+	ExportedAt    time.Time               `json:"exported_at"`
+	Profile       exportedProfile         `json:"profile"`
+	Chirps        []database.Chirp        `json:"chirps"`
+	Sessions      []exportedSession       `json:"sessions"`
+	Identities    []database.Identity     `json:"identities"`
+	Subscriptions []database.Subscription `json:"subscriptions"`
+
+	PersonalAccessTokens []personalAccessToken `json:"personal_access_tokens"`
+	WebhookEndpoints     []webhookEndpoint     `json:"webhook_endpoints"`
+}
+
+type exportedProfile struct {
+	Id            int       `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	IsChirpyRed   bool      `json:"is_chirpy_red"`
+	Handle        string    `json:"handle"`
+	DisplayName   string    `json:"display_name"`
+	Bio           string    `json:"bio"`
+	AvatarURL     string    `json:"avatar_url"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type exportedSession struct {
+	Id         int       `json:"id"`
+	SessionId  int       `json:"session_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RotatedAt  time.Time `json:"rotated_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// handlerUsersMeExportGet returns everything stored about the authenticated user,
+// as JSON or as a ZIP archive when format=zip
+func (a *apiConfig) handlerUsersMeExportGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		respondWithError(w, http.StatusBadRequest, "Format must be json or zip")
+		return
+	}
+
+	export, err := a.db.ExportUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't export user: %s", err))
+		return
+	}
+
+	account := accountExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: exportedProfile{
+			Id:            export.User.Id,
+			Email:         export.User.Email,
+			EmailVerified: export.User.EmailVerified,
+			IsChirpyRed:   export.User.IsChirpyRed,
+			Handle:        export.User.Handle,
+			DisplayName:   export.User.DisplayName,
+			Bio:           export.User.Bio,
+			AvatarURL:     export.User.AvatarURL,
+			CreatedAt:     export.User.CreatedAt,
+		},
+		Chirps:        export.Chirps,
+		Sessions:      make([]exportedSession, 0, len(export.RefreshTokens)),
+		Identities:    export.Identities,
+		Subscriptions: export.Subscriptions,
+
+		PersonalAccessTokens: make([]personalAccessToken, 0, len(export.PersonalAccessTokens)),
+		WebhookEndpoints:     make([]webhookEndpoint, 0, len(export.WebhookEndpoints)),
+	}
+	for _, refresh_token := range export.RefreshTokens {
+		account.Sessions = append(account.Sessions, exportedSession{
+			Id:         refresh_token.Id,
+			SessionId:  refresh_token.FamilyId,
+			CreatedAt:  refresh_token.CreatedAt,
+			LastUsedAt: refresh_token.LastUsedAt,
+			ExpiresAt:  refresh_token.ExpiresAt,
+			RotatedAt:  refresh_token.RotatedAt,
+			UserAgent:  refresh_token.UserAgent,
+			IP:         refresh_token.IP,
+		})
+	}
+
+	// Token digests and signing secrets are left out
+	for _, personal_access_token := range export.PersonalAccessTokens {
+		account.PersonalAccessTokens = append(account.PersonalAccessTokens, newPersonalAccessToken(personal_access_token))
+	}
+	for _, endpoint := range export.WebhookEndpoints {
+		account.WebhookEndpoints = append(account.WebhookEndpoints, newWebhookEndpoint(endpoint))
+	}
+
+	if format != "zip" {
+		respondWithJSON(w, http.StatusOK, account)
+		return
+	}
+
+	files := []struct {
+		name    string
+		payload interface{}
+	}{
+		{"profile.json", account.Profile},
+		{"chirps.json", account.Chirps},
+		{"sessions.json", account.Sessions},
+		{"identities.json", account.Identities},
+		{"subscriptions.json", account.Subscriptions},
+		{"personal_access_tokens.json", account.PersonalAccessTokens},
+		{"webhook_endpoints.json", account.WebhookEndpoints},
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, user.Id))
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+
+	for _, f := range files {
+		dat, err := json.MarshalIndent(f.payload, "", "  ")
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Couldn't marshal export", "error", err)
+			return
+		}
+
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     f.name,
+			Method:   zip.Deflate,
+			Modified: account.ExportedAt,
+		})
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Couldn't write export", "error", err)
+			return
+		}
+		file.Write(dat)
+	}
+}
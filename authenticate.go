@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/logging"
+)
+
+// middlewareAuth only lets a request through with a valid access token,
+// and stores the caller in the request context for auth.UserFromContext.
+// Personal access tokens must carry every one of scopes; without scopes
+// the route is only open to sessions.
+func (a *apiConfig) middlewareAuth(next http.HandlerFunc, scopes ...database.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		if !authorizeScopes(w, principal, scopes) {
+			return
+		}
+
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// middlewareOptionalAuth lets requests without credentials through anonymously.
+// Requests that do send credentials must send valid ones with scopes.
+func (a *apiConfig) middlewareOptionalAuth(next http.HandlerFunc, scopes ...database.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r)
+		if errors.Is(err, auth.ErrNoAuthHeader) {
+			next(w, r)
+			return
+		}
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		if !authorizeScopes(w, principal, scopes) {
+			return
+		}
+
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// withPrincipal stores the caller in ctx and tags its logs and span with the user
+func withPrincipal(ctx context.Context, principal *auth.Principal) context.Context {
+	tracePrincipal(ctx, principal)
+	return auth.WithPrincipal(logging.SetUser(ctx, principal.User.Id), principal)
+}
+
+func (a *apiConfig) authenticate(r *http.Request) (*auth.Principal, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.IsPersonalAccessToken(token) {
+		return auth.AuthenticatePersonalAccessToken(r.Context(), a.db, token)
+	}
+
+	return a.tokens.Authenticate(r.Context(), a.db, token)
+}
+
+// authorizeScopes responds 403 and returns false when the caller lacks one of scopes
+func authorizeScopes(w http.ResponseWriter, principal *auth.Principal, scopes []database.Scope) bool {
+	if principal.Kind != auth.TokenKindJWT && len(scopes) == 0 {
+		respondWithInsufficientScope(w, "Personal access tokens can't be used here")
+		return false
+	}
+
+	for _, scope := range scopes {
+		if !principal.HasScope(scope) {
+			respondWithInsufficientScope(w, fmt.Sprintf("This requires the %s scope", scope))
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,57 +1,150 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/entitlements"
+	"github.com/Hien-Trinh/chirpy/internal/webhooks"
 )
 
+// handlerChirpsPost posts a chirp, or schedules it when publish_at is in the future
 func (a *apiConfig) handlerChirpsPost(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	user, err := auth.GetUserByJWT(a.db, a.jwtSecret, token)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Couldn't get user: %s", err))
-		return
-	}
+	user, _ := auth.UserFromContext(r.Context())
+	plan := entitlements.For(user)
 
 	type parameters struct {
-		Body string `json:"body"`
+		Body      string     `json:"body"`
+		PublishAt *time.Time `json:"publish_at"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
 
-	const maxChirpLength = 140
-	if len(params.Body) > maxChirpLength {
-		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
+	if !checkChirpBody(w, plan, params.Body) {
 		return
 	}
 
-	chirp, err := a.db.CreateChirp(user.Id, getCleanedBody(params.Body))
+	now := time.Now()
+	publish_at := params.PublishAt
+	if publish_at != nil && !publish_at.After(now) {
+		publish_at = nil
+	}
+	if publish_at != nil {
+		if !plan.Has(entitlements.FeatureScheduledChirps) {
+			respondWithPremiumRequired(w, entitlements.FeatureScheduledChirps, "Scheduling chirps requires Chirpy Red")
+			return
+		}
+		if publish_at.Sub(now) > plan.Limits.MaxScheduleAhead {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Chirps can be scheduled at most %s ahead", plan.Limits.MaxScheduleAhead))
+			return
+		}
+		utc := publish_at.UTC()
+		publish_at = &utc
+	}
+
+	chirp, err := a.db.CreateChirp(r.Context(), user.Id, getCleanedBody(params.Body), publish_at, plan.Limits.ChirpsPerHour)
+	if errors.Is(err, database.ErrChirpRateLimited) {
+		a.respondWithChirpRateLimited(w, r, user.Id, plan.Limits.ChirpsPerHour)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create chirp: %s", err))
 		return
 	}
+	// Scheduled chirps are announced by publishScheduledChirps
+	if publish_at == nil {
+		a.emitWebhookEvent(r.Context(), webhooks.EventChirpCreated, user.Id, chirp)
+	}
 
 	respondWithJSON(w, 201, chirp)
 }
 
-// handlerChirpsGet returns all chirps
+// respondWithChirpRateLimited rejects a chirp from an author who already
+// posted max chirps in the last hour
+func (a *apiConfig) respondWithChirpRateLimited(w http.ResponseWriter, r *http.Request, author_id, max int) {
+	now := time.Now()
+	created, err := a.db.GetChirpCreationsSince(r.Context(), author_id, now.Add(-time.Hour))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get chirps: %s", err))
+		return
+	}
+
+	if len(created) >= max && max > 0 {
+		// A slot frees up an hour after the oldest chirp that still counts
+		retry_after := created[len(created)-max].Add(time.Hour).Sub(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry_after.Seconds()))))
+	}
+	respondWithErrorCode(w, http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("You can post at most %d chirps an hour", max))
+}
+
+// publishScheduledChirps sends chirp.created for scheduled chirps once
+// they are published, checking every interval until ctx is done
+func (a *apiConfig) publishScheduledChirps(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		chirps, err := a.db.GetDueScheduledChirps(ctx, time.Now())
+		if err != nil {
+			log.Printf("Couldn't get scheduled chirps: %s", err)
+		}
+		for _, chirp := range chirps {
+			// Left for the next round if queueing fails
+			err = a.queueWebhookEvent(ctx, webhooks.EventChirpCreated, chirp.AuthorId, chirp)
+			if err == nil {
+				err = a.db.MarkScheduledChirpPublished(ctx, chirp.Id)
+			}
+			if err != nil {
+				log.Printf("Couldn't publish scheduled chirp %d: %s", chirp.Id, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handlerChirpsGet returns all chirps.
+// Authenticated callers can pass author_id=me to get their own chirps,
+// and also see their own scheduled chirps.
 func (a *apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
 	var err error
 
+	viewer_id := -1
+	if viewer, ok := auth.UserFromContext(r.Context()); ok {
+		viewer_id = viewer.Id
+	}
+
 	id := r.URL.Query().Get("author_id")
 	author_id := -1
-	if id != "" {
+	if id == "me" {
+		user, ok := auth.UserFromContext(r.Context())
+		if !ok {
+			respondWithAuthError(w, auth.ErrNoAuthHeader)
+			return
+		}
+		author_id = user.Id
+	} else if id != "" {
 		author_id, err = strconv.Atoi(id)
 		if err != nil {
 			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid author_id: %s", err))
@@ -64,7 +157,7 @@ func (a *apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
 	if sort == "desc" {
 		sort_reverse = true
 	}
-	chirps, err := a.db.GetChirps(author_id, sort_reverse)
+	chirps, err := a.db.GetChirps(r.Context(), author_id, viewer_id, sort_reverse)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get chirp: %s", err))
 		return
@@ -75,13 +168,18 @@ func (a *apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
 
 // handlerChirpsGetById returns a chirp by ID
 func (a *apiConfig) handlerChirpsGetById(w http.ResponseWriter, r *http.Request) {
+	viewer_id := -1
+	if viewer, ok := auth.UserFromContext(r.Context()); ok {
+		viewer_id = viewer.Id
+	}
+
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
 		return
 	}
 
-	chirp, err := a.db.GetChirpById(id)
+	chirp, err := a.db.GetChirpById(r.Context(), id, viewer_id)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't get chirp: %s", err))
 		return
@@ -93,12 +191,7 @@ func (a *apiConfig) handlerChirpsGetById(w http.ResponseWriter, r *http.Request)
 
 // handlerChirpsDeleteById deletes a chirp by ID
 func (a *apiConfig) handlerChirpsDeleteById(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	user, err := auth.GetUserByJWT(a.db, a.jwtSecret, token)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Couldn't get user: %s", err))
-		return
-	}
+	user, _ := auth.UserFromContext(r.Context())
 
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
@@ -106,7 +199,7 @@ func (a *apiConfig) handlerChirpsDeleteById(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	chirp, err := a.db.GetChirpById(id)
+	chirp, err := a.db.GetChirpById(r.Context(), id, user.Id)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't get chirp: %s", err))
 		return
@@ -117,16 +210,93 @@ func (a *apiConfig) handlerChirpsDeleteById(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = a.db.DeleteChirpById(id)
+	err = a.db.DeleteChirpById(r.Context(), id)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't delete chirp: %s", err))
 		return
 	}
+	a.emitWebhookEvent(r.Context(), webhooks.EventChirpDeleted, user.Id, struct {
+		Id       int `json:"id"`
+		AuthorId int `json:"author_id"`
+	}{
+		Id:       chirp.Id,
+		AuthorId: chirp.AuthorId,
+	})
 
 	respondWithJSON(w, http.StatusNoContent, nil)
 
 }
 
+// handlerChirpsPutById edits the body of one of the caller's chirps
+func (a *apiConfig) handlerChirpsPutById(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+	plan := entitlements.For(user)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	chirp, err := a.db.GetChirpById(r.Context(), id, user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't get chirp: %s", err))
+		return
+	}
+
+	if chirp.AuthorId != user.Id {
+		respondWithError(w, http.StatusForbidden, "You can only edit your own chirps")
+		return
+	}
+
+	if !plan.Has(entitlements.FeatureChirpEditing) {
+		respondWithPremiumRequired(w, entitlements.FeatureChirpEditing, "Editing chirps requires Chirpy Red")
+		return
+	}
+
+	if !checkChirpBody(w, plan, params.Body) {
+		return
+	}
+
+	chirp, err = a.db.UpdateChirpBody(r.Context(), id, getCleanedBody(params.Body))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update chirp: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// checkChirpBody responds with an error and returns false when the plan
+// doesn't allow a chirp this long
+func checkChirpBody(w http.ResponseWriter, plan entitlements.Entitlements, body string) bool {
+	length := utf8.RuneCountInString(body)
+	if length <= plan.Limits.MaxChirpLength {
+		return true
+	}
+
+	premium_length := entitlements.Plan(entitlements.TierChirpyRed).Limits.MaxChirpLength
+	if !plan.Has(entitlements.FeatureLongChirps) && length <= premium_length {
+		respondWithPremiumRequired(w, entitlements.FeatureLongChirps, fmt.Sprintf("Chirps longer than %d characters require Chirpy Red", plan.Limits.MaxChirpLength))
+		return false
+	}
+
+	respondWithError(w, http.StatusBadRequest, "Chirp is too long")
+	return false
+}
+
 func getCleanedBody(body string) string {
 	profaneWords := map[string]struct{}{
 		"kerfuffle": {},
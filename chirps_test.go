@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/entitlements"
+	"github.com/Hien-Trinh/chirpy/internal/webhooks"
+)
+
+// queuedEvents returns the events queued for every webhook endpoint
+func (api *testAPI) queuedEvents() []string {
+	api.t.Helper()
+	ctx := context.Background()
+
+	deliveries, err := api.cfg.db.GetDueWebhookDeliveries(ctx, time.Now().Add(time.Hour), 100)
+	if err != nil {
+		api.t.Fatalf("GetDueWebhookDeliveries: %v", err)
+	}
+	events := make([]string, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		events = append(events, delivery.Event)
+	}
+	return events
+}
+
+func TestScheduledChirpCreatedEvent(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+
+	// Scheduling needs Chirpy Red
+	_, err := api.cfg.db.StartSubscription(ctx, user.Id, database.PlanChirpyRed, time.Time{})
+	if err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+	_, err = api.cfg.db.CreateWebhookEndpoint(ctx, user.Id, "https://example.com/hook", "secret", []string{webhooks.EventChirpCreated})
+	if err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+	login := api.login("user@example.com", testPassword)
+
+	publish_at := time.Now().Add(time.Hour).UTC()
+	chirp := database.Chirp{}
+	res := api.do(http.MethodPost, "/api/chirps", login.Token, map[string]interface{}{
+		"body":       "later",
+		"publish_at": publish_at,
+	}, &chirp)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("scheduling a chirp: status %d", res.StatusCode)
+	}
+	if events := api.queuedEvents(); len(events) != 0 {
+		t.Fatalf("events %v queued before the chirp was published", events)
+	}
+
+	due, err := api.cfg.db.GetDueScheduledChirps(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("GetDueScheduledChirps: %v", err)
+	}
+	if len(due) != 0 {
+		t.Fatalf("%d chirps due before their publish time", len(due))
+	}
+
+	due, err = api.cfg.db.GetDueScheduledChirps(ctx, publish_at)
+	if err != nil {
+		t.Fatalf("GetDueScheduledChirps: %v", err)
+	}
+	if len(due) != 1 || due[0].Id != chirp.Id {
+		t.Fatalf("got %+v due at the publish time, want chirp %d", due, chirp.Id)
+	}
+
+	res = api.do(http.MethodPost, "/api/chirps", login.Token, map[string]string{"body": "now"}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("posting a chirp: status %d", res.StatusCode)
+	}
+	if events := api.queuedEvents(); len(events) != 1 || events[0] != webhooks.EventChirpCreated {
+		t.Fatalf("got events %v for a chirp published right away, want one chirp.created", events)
+	}
+}
+
+func TestPublishScheduledChirps(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+
+	_, err := api.cfg.db.CreateWebhookEndpoint(ctx, user.Id, "https://example.com/hook", "secret", []string{webhooks.EventChirpCreated})
+	if err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+
+	// Published a moment ago, as if the server was down at the time
+	publish_at := time.Now().Add(-time.Second)
+	_, err = api.cfg.db.CreateChirp(ctx, user.Id, "scheduled", &publish_at, 100)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	// A canceled context makes the worker stop after one round
+	worker_ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	api.cfg.publishScheduledChirps(worker_ctx, time.Hour)
+
+	if events := api.queuedEvents(); len(events) != 1 || events[0] != webhooks.EventChirpCreated {
+		t.Fatalf("got events %v, want one chirp.created", events)
+	}
+
+	// Each chirp is announced once
+	api.cfg.publishScheduledChirps(worker_ctx, time.Hour)
+	if events := api.queuedEvents(); len(events) != 1 {
+		t.Fatalf("got events %v after a second round, want one", events)
+	}
+}
+
+func TestChirpRateLimit(t *testing.T) {
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+	login := api.login("user@example.com", testPassword)
+	limit := entitlements.For(user).Limits.ChirpsPerHour
+
+	// Concurrent posts are counted one at a time, so only limit get through
+	attempts := limit + 10
+	statuses := make([]int, attempts)
+	chirps := make([]database.Chirp, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := api.do(http.MethodPost, "/api/chirps", login.Token, map[string]string{"body": "hello"}, &chirps[i])
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != limit || counts[http.StatusTooManyRequests] != attempts-limit {
+		t.Fatalf("statuses = %v, want %d created and the rest rate limited", counts, limit)
+	}
+
+	// Deleting a chirp doesn't free up its slot
+	for i, status := range statuses {
+		if status != http.StatusCreated {
+			continue
+		}
+		res := api.do(http.MethodDelete, "/api/chirps/"+strconv.Itoa(chirps[i].Id), login.Token, nil, nil)
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("deleting chirp %d: status %d", chirps[i].Id, res.StatusCode)
+		}
+		break
+	}
+	res := api.do(http.MethodPost, "/api/chirps", login.Token, map[string]string{"body": "again"}, nil)
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("posting after a delete: status %d, want %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+	if retry_after, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || retry_after < 1 || retry_after > 3600 {
+		t.Fatalf("Retry-After = %q, want up to an hour", res.Header.Get("Retry-After"))
+	}
+}
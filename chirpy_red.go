@@ -1,44 +1,155 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/signature"
+	"github.com/Hien-Trinh/chirpy/internal/webhooks"
+)
+
+const (
+	polkaSource = "polka"
+
+	// maxWebhookBodyBytes bounds the payload read before the signature is checked
+	maxWebhookBodyBytes = 64 << 10
 )
 
+// handlerChirpyRedPost receives Polka payment events. Retries of an
+// event that was already handled are acknowledged without effect.
 func (a *apiConfig) handlerChirpyRedPost(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "ApiKey ")
-	if token != a.polkaApiKey {
+	api_key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+	if !ok || a.polkaApiKey == "" || subtle.ConstantTimeCompare([]byte(api_key), []byte(a.polkaApiKey)) != 1 {
 		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
 		return
 	}
 
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read body")
+		return
+	}
+
+	// Without a secret nothing can be verified, and Polka retries until one is set
+	if len(a.polkaWebhookSecret) == 0 {
+		respondWithError(w, http.StatusServiceUnavailable, "Webhook signing secret isn't configured")
+		return
+	}
+	err = signature.Verify(r.Header.Get("Polka-Signature"), a.polkaWebhookSecret, body, a.polkaWebhookTolerance, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Invalid signature: %s", err))
+		return
+	}
+
 	type parameters struct {
+		Id    string `json:"id"`
 		Event string `json:"event"`
 		Data  struct {
-			UserId int `json:"user_id"`
+			UserId           int       `json:"user_id"`
+			CurrentPeriodEnd time.Time `json:"current_period_end"`
+			CancelAt         time.Time `json:"cancel_at"`
 		} `json:"data"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err = json.Unmarshal(body, &params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	event_id := params.Id
+	if event_id == "" {
+		event_id = r.Header.Get("Polka-Event-Id")
+	}
+	// Events can only be deduplicated by id, and a signed event without
+	// one could be replayed for as long as its signature is fresh
+	if event_id == "" {
+		respondWithError(w, http.StatusBadRequest, "Event id is required")
 		return
 	}
 
-	if params.Event != "user.upgraded" {
+	webhook_event, err := a.db.CreateWebhookEvent(r.Context(), polkaSource, event_id, params.Event, params.Data.UserId)
+	if errors.Is(err, database.ErrWebhookEventDuplicate) {
 		respondWithJSON(w, http.StatusNoContent, nil)
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't record event: %s", err))
+		return
+	}
 
-	_, err = a.db.UpdateUserChirpyRed(params.Data.UserId, true)
+	switch params.Event {
+	case "user.upgraded":
+		_, err = a.db.StartSubscription(r.Context(), params.Data.UserId, database.PlanChirpyRed, params.Data.CurrentPeriodEnd)
+	case "user.subscription_canceled":
+		_, err = a.db.ScheduleSubscriptionCancel(r.Context(), params.Data.UserId, database.PlanChirpyRed, params.Data.CancelAt)
+	case "user.downgraded", "user.refunded":
+		err = a.db.EndSubscription(r.Context(), params.Data.UserId, database.PlanChirpyRed, database.SubscriptionCanceled)
+	case "user.subscription_expired":
+		err = a.db.EndSubscription(r.Context(), params.Data.UserId, database.PlanChirpyRed, database.SubscriptionExpired)
+	default:
+		a.finishWebhookEvent(r.Context(), w, webhook_event, database.WebhookEventIgnored)
+		return
+	}
 	if err != nil {
+		// Failed events are retried by Polka and then handled again
+		status_err := a.db.UpdateWebhookEventStatus(r.Context(), webhook_event.Id, database.WebhookEventFailed, err.Error())
+		if status_err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't record event: %s", status_err))
+			return
+		}
 		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't update user: %s", err))
 		return
 	}
 
+	if params.Event == "user.upgraded" {
+		a.emitWebhookEvent(r.Context(), webhooks.EventUserUpgraded, params.Data.UserId, struct {
+			UserId int `json:"user_id"`
+		}{
+			UserId: params.Data.UserId,
+		})
+	}
+
+	a.finishWebhookEvent(r.Context(), w, webhook_event, database.WebhookEventProcessed)
+}
+
+func (a *apiConfig) finishWebhookEvent(ctx context.Context, w http.ResponseWriter, webhook_event database.WebhookEvent, status database.WebhookEventStatus) {
+	err := a.db.UpdateWebhookEventStatus(ctx, webhook_event.Id, status, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't record event: %s", err))
+		return
+	}
+
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
+
+// handlerAdminPolkaWebhooksGet lists the most recent Polka events
+func (a *apiConfig) handlerAdminPolkaWebhooksGet(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if limit_string := r.URL.Query().Get("limit"); limit_string != "" {
+		parsed, err := strconv.Atoi(limit_string)
+		if err != nil || parsed < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	webhook_events, err := a.db.GetWebhookEvents(r.Context(), polkaSource, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get webhook events: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, webhook_events)
+}
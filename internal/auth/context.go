@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+type contextKey int
+
+const principalContextKey contextKey = iota
+
+// TokenKind is the kind of credential a request was authenticated with
+type TokenKind string
+
+const (
+	TokenKindJWT                 TokenKind = "jwt"
+	TokenKindPersonalAccessToken TokenKind = "personal_access_token"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	User database.User
+	Kind TokenKind
+	// Claims is only set for JWTs
+	Claims *Claims
+	// Scopes is only set for personal access tokens
+	Scopes []database.Scope
+}
+
+// HasScope reports whether the caller may act within scope.
+// Sessions can do anything the user can.
+func (p *Principal) HasScope(scope database.Scope) bool {
+	if p.Kind == TokenKindJWT {
+		return true
+	}
+
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPrincipal returns a copy of ctx carrying the authenticated caller
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, principal)
+}
+
+// PrincipalFromContext returns the authenticated caller stored in ctx, if any
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey).(*Principal)
+	return principal, ok
+}
+
+// UserFromContext returns the authenticated user stored in ctx, if any
+func UserFromContext(ctx context.Context) (database.User, bool) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return database.User{}, false
+	}
+
+	return principal.User, true
+}
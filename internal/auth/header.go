@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrNoAuthHeader        = errors.New("no authorization header")
+	ErrMalformedAuthHeader = errors.New("malformed authorization header")
+)
+
+// GetAuthorization returns the credentials of an Authorization header
+// using scheme, which is compared case-insensitively.
+// A missing header returns ErrNoAuthHeader and any other scheme or
+// shape returns ErrMalformedAuthHeader.
+func GetAuthorization(headers http.Header, scheme string) (string, error) {
+	header := headers.Get("Authorization")
+	if header == "" {
+		return "", ErrNoAuthHeader
+	}
+
+	header_scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(header_scheme, scheme) {
+		return "", ErrMalformedAuthHeader
+	}
+
+	credentials = strings.TrimLeft(credentials, " ")
+	if credentials == "" || strings.ContainsAny(credentials, " \t") {
+		return "", ErrMalformedAuthHeader
+	}
+
+	return credentials, nil
+}
+
+// GetBearerToken returns the token of a "Bearer" Authorization header (RFC 6750)
+func GetBearerToken(headers http.Header) (string, error) {
+	return GetAuthorization(headers, "Bearer")
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -9,15 +11,91 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func CreateJWT(jwtSecret string, userID int) (string, error) {
-	claims := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour).UTC()),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		Issuer:    "chirpy",
-		Subject:   strconv.Itoa(userID),
+var (
+	ErrTokenMalformed     = errors.New("token is malformed")
+	ErrTokenExpired       = errors.New("token has expired")
+	ErrTokenSignature     = errors.New("token signature is invalid")
+	ErrTokenWrongIssuer   = errors.New("token has the wrong issuer")
+	ErrTokenWrongAudience = errors.New("token has the wrong audience")
+	ErrTokenInvalid       = errors.New("token is invalid")
+)
+
+// Claims are the claims carried by Chirpy access tokens
+type Claims struct {
+	Role database.Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// TokenConfig holds the settings access tokens are minted and checked with
+type TokenConfig struct {
+	Issuer   string
+	Audience string
+	TTL      time.Duration
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat
+	Leeway time.Duration
+}
+
+// challengeTTL is how long a user has to complete a second factor after their password
+const challengeTTL = time.Minute * 5
+
+// TokenService mints and validates access tokens
+type TokenService struct {
+	keys            *KeySet
+	cfg             TokenConfig
+	parser          *jwt.Parser
+	challengeParser *jwt.Parser
+}
+
+// NewTokenService creates a token service that signs with keys.
+// Only the algorithms of keys in the set are accepted.
+func NewTokenService(keys *KeySet, cfg TokenConfig) *TokenService {
+	return &TokenService{
+		keys: keys,
+		cfg:  cfg,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(keys.Algorithms()),
+			jwt.WithIssuer(cfg.Issuer),
+			jwt.WithAudience(cfg.Audience),
+			jwt.WithLeeway(cfg.Leeway),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		),
+		challengeParser: jwt.NewParser(
+			jwt.WithValidMethods(keys.Algorithms()),
+			jwt.WithIssuer(cfg.Issuer),
+			jwt.WithAudience(challengeAudience(cfg.Audience)),
+			jwt.WithLeeway(cfg.Leeway),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token_signed, err := token.SignedString([]byte(jwtSecret))
+}
+
+// challengeAudience keeps challenge tokens and access tokens from
+// being accepted in place of each other
+func challengeAudience(audience string) string {
+	return audience + ":2fa"
+}
+
+// Create creates an access token for a user, signed with the current signing key
+func (s *TokenService) Create(userID int, role database.Role) (string, error) {
+	if role == "" {
+		role = database.RoleUser
+	}
+
+	now := time.Now().UTC()
+	claims := Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.cfg.TTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    s.cfg.Issuer,
+			Audience:  jwt.ClaimStrings{s.cfg.Audience},
+			Subject:   strconv.Itoa(userID),
+		},
+	}
+
+	token_signed, err := s.keys.Sign(claims)
 	if err != nil {
 		return "", fmt.Errorf("couldn't create token: %s", err)
 	}
@@ -25,43 +103,98 @@ func CreateJWT(jwtSecret string, userID int) (string, error) {
 	return token_signed, nil
 }
 
-// GetUserByJWT returns a user by JWT
-func GetUserByJWT(db *database.DB, jwtSecret, token string) (database.User, error) {
-	token_parsed, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+// Validate checks the signature, algorithm, issuer, audience and lifetime
+// of an access token and returns its claims.
+// Errors are one of the ErrToken values.
+func (s *TokenService) Validate(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := s.parser.ParseWithClaims(token, claims, s.keys.Keyfunc)
 	if err != nil {
-		return database.User{}, fmt.Errorf("couldn't parse token: %s", err)
+		return nil, tokenError(err)
 	}
 
-	claims, ok := token_parsed.Claims.(*jwt.RegisteredClaims)
-	if !ok {
-		return database.User{}, fmt.Errorf("couldn't parse claims")
+	if claims.Subject == "" {
+		return nil, ErrTokenInvalid
 	}
 
-	token_expiration_time, err := claims.GetExpirationTime()
+	return claims, nil
+}
+
+// CreateChallenge creates a short-lived token proving a user got their
+// password right, to be exchanged for access and refresh tokens once
+// they pass their second factor
+func (s *TokenService) CreateChallenge(userID int) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(challengeTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
+		Issuer:    s.cfg.Issuer,
+		Audience:  jwt.ClaimStrings{challengeAudience(s.cfg.Audience)},
+		Subject:   strconv.Itoa(userID),
+	}
+
+	token_signed, err := s.keys.Sign(claims)
 	if err != nil {
-		return database.User{}, fmt.Errorf("couldn't get expiration time: %s", err)
+		return "", fmt.Errorf("couldn't create token: %s", err)
 	}
 
-	if token_expiration_time.Before(time.Now().UTC()) {
-		return database.User{}, fmt.Errorf("token has expired")
+	return token_signed, nil
+}
+
+// ValidateChallenge checks a challenge token and returns the ID of the user it was issued to
+func (s *TokenService) ValidateChallenge(token string) (int, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := s.challengeParser.ParseWithClaims(token, claims, s.keys.Keyfunc)
+	if err != nil {
+		return 0, tokenError(err)
 	}
 
-	subject, err := claims.GetSubject()
+	user_id, err := strconv.Atoi(claims.Subject)
 	if err != nil {
-		return database.User{}, fmt.Errorf("couldn't get subject: %s", err)
+		return 0, ErrTokenInvalid
 	}
 
-	user_id, err := strconv.Atoi(subject)
+	return user_id, nil
+}
+
+// Authenticate validates an access token and loads the user it was issued to
+func (s *TokenService) Authenticate(ctx context.Context, db *database.DB, token string) (*Principal, error) {
+	claims, err := s.Validate(token)
 	if err != nil {
-		return database.User{}, fmt.Errorf("couldn't parse user ID")
+		return nil, err
 	}
 
-	user, err := db.GetUserById(user_id)
+	user_id, err := strconv.Atoi(claims.Subject)
 	if err != nil {
-		return database.User{}, fmt.Errorf("couldn't get user: %s", err)
+		return nil, ErrTokenInvalid
 	}
 
-	return user, nil
+	user, err := db.GetUserById(ctx, user_id)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	return &Principal{
+		User:   user,
+		Kind:   TokenKindJWT,
+		Claims: claims,
+	}, nil
+}
+
+// tokenError maps errors from the jwt package to the ErrToken values
+func tokenError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return ErrTokenMalformed
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrTokenSignature
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrTokenWrongIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return ErrTokenWrongAudience
+	default:
+		return ErrTokenInvalid
+	}
 }
@@ -0,0 +1,344 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer     = "chirpy"
+	testAudience   = "chirpy"
+	testHMACSecret = "test-secret"
+	testEdKeyId    = "ed1"
+)
+
+// newTestKeySet returns a key set that signs with an Ed25519 key and
+// still accepts HS256 tokens, along with the Ed25519 private key
+func newTestKeySet(t *testing.T) (*KeySet, ed25519.PrivateKey) {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+
+	dir := t.TempDir()
+	dat := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = os.WriteFile(filepath.Join(dir, testEdKeyId+".pem"), dat, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	keys, err := NewKeySet(KeySetConfig{Dir: dir, HMACSecret: testHMACSecret})
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+
+	return keys, private
+}
+
+// validClaims returns the claims of an access token that passes validation
+func validClaims(now time.Time) Claims {
+	return Claims{
+		Role: database.RoleUser,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    testIssuer,
+			Audience:  jwt.ClaimStrings{testAudience},
+			Subject:   "1",
+		},
+	}
+}
+
+// signToken signs claims with method and key, setting kid unless it is empty
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	token_signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	return token_signed
+}
+
+func TestValidate(t *testing.T) {
+	keys, private := newTestKeySet(t)
+	now := time.Now().UTC()
+	hmac := []byte(testHMACSecret)
+
+	tests := []struct {
+		name  string
+		token func() string
+		want  error
+	}{
+		{
+			name: "EdDSA",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, validClaims(now))
+			},
+		},
+		{
+			name: "HS256 with kid",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodHS256, hmac, hmacKeyId, validClaims(now))
+			},
+		},
+		{
+			name: "HS256 without kid",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodHS256, hmac, "", validClaims(now))
+			},
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := validClaims(now.Add(-2 * time.Hour))
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenExpired,
+		},
+		{
+			name: "not yet valid",
+			token: func() string {
+				claims := validClaims(now)
+				claims.NotBefore = jwt.NewNumericDate(now.Add(time.Minute))
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenInvalid,
+		},
+		{
+			name: "issued in the future",
+			token: func() string {
+				claims := validClaims(now)
+				claims.IssuedAt = jwt.NewNumericDate(now.Add(time.Minute))
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenInvalid,
+		},
+		{
+			name: "without expiry",
+			token: func() string {
+				claims := validClaims(now)
+				claims.ExpiresAt = nil
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenInvalid,
+		},
+		{
+			name: "without subject",
+			token: func() string {
+				claims := validClaims(now)
+				claims.Subject = ""
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenInvalid,
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := validClaims(now)
+				claims.Issuer = "someone-else"
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenWrongIssuer,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := validClaims(now)
+				claims.Audience = jwt.ClaimStrings{"someone-else"}
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenWrongAudience,
+		},
+		{
+			name: "challenge audience",
+			token: func() string {
+				claims := validClaims(now)
+				claims.Audience = jwt.ClaimStrings{challengeAudience(testAudience)}
+				return signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, claims)
+			},
+			want: ErrTokenWrongAudience,
+		},
+		{
+			name: "alg none",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", validClaims(now))
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name: "algorithm not in the key set",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodHS384, hmac, hmacKeyId, validClaims(now))
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name: "HS256 under the EdDSA kid",
+			token: func() string {
+				// The public key as an HMAC secret is the classic algorithm confusion attack
+				public := []byte(private.Public().(ed25519.PublicKey))
+				return signToken(t, jwt.SigningMethodHS256, public, testEdKeyId, validClaims(now))
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name: "EdDSA under the HS256 kid",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodEdDSA, private, hmacKeyId, validClaims(now))
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name: "unknown kid",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodEdDSA, private, "ed2", validClaims(now))
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name: "wrong HMAC secret",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodHS256, []byte("other-secret"), hmacKeyId, validClaims(now))
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name: "tampered signature",
+			token: func() string {
+				token := signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, validClaims(now))
+				last := token[len(token)-2]
+				if last == 'A' {
+					last = 'B'
+				} else {
+					last = 'A'
+				}
+				return token[:len(token)-2] + string(last) + token[len(token)-1:]
+			},
+			want: ErrTokenSignature,
+		},
+		{
+			name:  "malformed",
+			token: func() string { return "not-a-jwt" },
+			want:  ErrTokenMalformed,
+		},
+	}
+
+	tokens := NewTokenService(keys, TokenConfig{Issuer: testIssuer, Audience: testAudience, TTL: time.Hour})
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := tokens.Validate(tc.token())
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Validate() error = %v, want %v", err, tc.want)
+			}
+			if tc.want == nil && claims.Subject != "1" {
+				t.Fatalf("Validate() subject = %q, want %q", claims.Subject, "1")
+			}
+		})
+	}
+}
+
+func TestValidateLeeway(t *testing.T) {
+	keys, private := newTestKeySet(t)
+	now := time.Now().UTC()
+
+	expired := validClaims(now.Add(-time.Hour))
+	expired.ExpiresAt = jwt.NewNumericDate(now.Add(-10 * time.Second))
+	not_yet_valid := validClaims(now)
+	not_yet_valid.NotBefore = jwt.NewNumericDate(now.Add(10 * time.Second))
+	issued_ahead := validClaims(now)
+	issued_ahead.IssuedAt = jwt.NewNumericDate(now.Add(10 * time.Second))
+
+	tests := []struct {
+		name   string
+		claims Claims
+	}{
+		{"expired", expired},
+		{"not yet valid", not_yet_valid},
+		{"issued in the future", issued_ahead},
+	}
+
+	strict := NewTokenService(keys, TokenConfig{Issuer: testIssuer, Audience: testAudience, TTL: time.Hour})
+	lenient := NewTokenService(keys, TokenConfig{Issuer: testIssuer, Audience: testAudience, TTL: time.Hour, Leeway: 30 * time.Second})
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token := signToken(t, jwt.SigningMethodEdDSA, private, testEdKeyId, tc.claims)
+
+			_, err := strict.Validate(token)
+			if err == nil {
+				t.Fatal("Validate() without leeway accepted the token")
+			}
+			_, err = lenient.Validate(token)
+			if err != nil {
+				t.Fatalf("Validate() with leeway: %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateAndValidate(t *testing.T) {
+	keys, _ := newTestKeySet(t)
+	tokens := NewTokenService(keys, TokenConfig{Issuer: testIssuer, Audience: testAudience, TTL: time.Hour})
+
+	token, err := tokens.Create(42, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	claims, err := tokens.Validate(token)
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if claims.Subject != "42" || claims.Role != database.RoleUser {
+		t.Fatalf("claims = %q/%q, want 42/%q", claims.Subject, claims.Role, database.RoleUser)
+	}
+
+	_, err = tokens.ValidateChallenge(token)
+	if !errors.Is(err, ErrTokenWrongAudience) {
+		t.Fatalf("ValidateChallenge(access token) error = %v, want %v", err, ErrTokenWrongAudience)
+	}
+}
+
+func TestCreateAndValidateChallenge(t *testing.T) {
+	keys, _ := newTestKeySet(t)
+	tokens := NewTokenService(keys, TokenConfig{Issuer: testIssuer, Audience: testAudience, TTL: time.Hour})
+
+	challenge, err := tokens.CreateChallenge(42)
+	if err != nil {
+		t.Fatalf("CreateChallenge: %v", err)
+	}
+
+	user_id, err := tokens.ValidateChallenge(challenge)
+	if err != nil {
+		t.Fatalf("ValidateChallenge: %v", err)
+	}
+	if user_id != 42 {
+		t.Fatalf("ValidateChallenge() = %d, want 42", user_id)
+	}
+
+	_, err = tokens.Validate(challenge)
+	if !errors.Is(err, ErrTokenWrongAudience) {
+		t.Fatalf("Validate(challenge) error = %v, want %v", err, ErrTokenWrongAudience)
+	}
+}
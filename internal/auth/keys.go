@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// hmacKeyId identifies the shared secret. Tokens minted before
+// key ids were introduced have no kid and are checked against it.
+const hmacKeyId = "hs256"
+
+const minRSAKeyBits = 2048
+
+// Key is a key that signs or verifies Chirpy JWTs
+type Key struct {
+	Id     string
+	Method jwt.SigningMethod
+
+	signingKey   interface{}
+	verifyingKey interface{}
+}
+
+// KeySet holds the key new tokens are signed with and every key
+// tokens are still accepted from, so keys can be rotated without downtime
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// KeySetConfig describes where to find signing keys
+type KeySetConfig struct {
+	// Dir holds one PEM file per key, named <kid>.pem.
+	// Private keys (RSA or Ed25519) can sign; public keys only verify.
+	Dir string
+	// SigningKeyId picks the key new tokens are signed with.
+	// It can be left out when Dir holds a single private key.
+	SigningKeyId string
+	// HMACSecret signs tokens with HS256 when Dir is empty.
+	// Otherwise it is only used to verify tokens signed before the switch.
+	HMACSecret string
+}
+
+// NewKeySet loads signing and verification keys
+func NewKeySet(cfg KeySetConfig) (*KeySet, error) {
+	ks := &KeySet{
+		keys: make(map[string]*Key),
+	}
+
+	if cfg.HMACSecret != "" {
+		ks.keys[hmacKeyId] = &Key{
+			Id:           hmacKeyId,
+			Method:       jwt.SigningMethodHS256,
+			signingKey:   []byte(cfg.HMACSecret),
+			verifyingKey: []byte(cfg.HMACSecret),
+		}
+	}
+
+	if cfg.Dir == "" {
+		if cfg.HMACSecret == "" {
+			return nil, errors.New("no JWT keys configured")
+		}
+		ks.signing = ks.keys[hmacKeyId]
+		return ks, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(cfg.Dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	signingKeyId := cfg.SigningKeyId
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load key %s: %s", path, err)
+		}
+		ks.keys[key.Id] = key
+
+		if cfg.SigningKeyId == "" && key.signingKey != nil {
+			if signingKeyId != "" {
+				return nil, errors.New("several private keys found, set a signing key id")
+			}
+			signingKeyId = key.Id
+		}
+	}
+
+	key, ok := ks.keys[signingKeyId]
+	if !ok || key.signingKey == nil || key.Id == hmacKeyId {
+		return nil, fmt.Errorf("no private key found for signing key id %q", signingKeyId)
+	}
+	ks.signing = key
+
+	return ks, nil
+}
+
+// loadKey reads a PEM encoded key, using the file name as key id
+func loadKey(path string) (*Key, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key := &Key{
+		Id: strings.TrimSuffix(filepath.Base(path), ".pem"),
+	}
+	if key.Id == hmacKeyId {
+		return nil, fmt.Errorf("key id %q is reserved", hmacKeyId)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.signingKey = k
+		key.verifyingKey = &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+		key.verifyingKey = k
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.signingKey = k
+		key.verifyingKey = k.Public()
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.verifyingKey = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if public, ok := key.verifyingKey.(*rsa.PublicKey); ok && public.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+	}
+
+	return key, nil
+}
+
+// Sign signs claims with the current signing key
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.Id
+
+	return token.SignedString(ks.signing.signingKey)
+}
+
+// Algorithms returns the signing algorithms of every key in the set
+func (ks *KeySet) Algorithms() []string {
+	algs := make([]string, 0, len(ks.keys))
+	seen := make(map[string]bool)
+	for _, key := range ks.keys {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+
+	sort.Strings(algs)
+
+	return algs
+}
+
+// Keyfunc finds the key a token was signed with from its kid header.
+// The token must use the algorithm that belongs to that key.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = hmacKeyId
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	return key.verifyingKey, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is a set of public keys in JSON Web Key Set format
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric verification key.
+// The HMAC secret is never published.
+func (ks *KeySet) JWKS() JWKSet {
+	set := JWKSet{
+		Keys: make([]JWK, 0, len(ks.keys)),
+	}
+
+	for _, key := range ks.keys {
+		jwk := JWK{
+			Kid: key.Id,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+		}
+
+		switch public := key.verifyingKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	return set
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/token"
+)
+
+// PersonalAccessTokenPrefix starts every personal access token, so they
+// are easy to tell apart from JWTs and to spot in leaked secrets
+const PersonalAccessTokenPrefix = "chirpy_pat_"
+
+// lastUsedResolution limits how often the last use of a token is saved
+const lastUsedResolution = time.Minute
+
+// IsPersonalAccessToken reports whether token looks like a personal access token
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// NewPersonalAccessToken returns a new personal access token along with
+// the digest to store and a short hint to show in listings
+func NewPersonalAccessToken() (string, string, string, error) {
+	random, err := token.Generate()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	personal_access_token := PersonalAccessTokenPrefix + random
+	hint := PersonalAccessTokenPrefix + random[:4]
+
+	return personal_access_token, token.Hash(personal_access_token), hint, nil
+}
+
+// AuthenticatePersonalAccessToken looks up a personal access token
+// and loads the user it belongs to
+func AuthenticatePersonalAccessToken(ctx context.Context, db *database.DB, personal_access_token string) (*Principal, error) {
+	stored, err := db.GetPersonalAccessTokenByHash(ctx, token.Hash(personal_access_token))
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if stored.Expired() {
+		return nil, ErrTokenExpired
+	}
+
+	user, err := db.GetUserById(ctx, stored.UserID)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(stored.LastUsedAt) > lastUsedResolution {
+		err = db.TouchPersonalAccessToken(ctx, stored.Id, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Principal{
+		User:   user,
+		Kind:   TokenKindPersonalAccessToken,
+		Scopes: stored.Scopes,
+	}, nil
+}
@@ -1,34 +1,74 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"sort"
+	"time"
 )
 
+// ErrChirpRateLimited is returned when an author has posted as many chirps
+// in the last chirpRateWindow as they may
+var ErrChirpRateLimited = errors.New("too many chirps")
+
+// chirpRateWindow is how long a chirp counts against its author's rate limit
+const chirpRateWindow = time.Hour
+
 type Chirp struct {
-	Id       int    `json:"id"`
-	AuthorId int    `json:"author_id"`
-	Body     string `json:"body"`
+	Id        int        `json:"id"`
+	AuthorId  int        `json:"author_id"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	// PublishAt is set for scheduled chirps; only the author
+	// sees a chirp before it is published
+	PublishAt *time.Time `json:"publish_at,omitempty"`
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(author_id int, body string) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+// Published reports whether the chirp is visible to everyone at now
+func (c Chirp) Published(now time.Time) bool {
+	return c.PublishAt == nil || !now.Before(*c.PublishAt)
+}
+
+// visibleTo reports whether viewer_id may see the chirp at now
+func (c Chirp) visibleTo(viewer_id int, now time.Time) bool {
+	return c.Published(now) || c.AuthorId == viewer_id
+}
 
-	uniqueId := len(dbStructure.Chirps) + 1
+// CreateChirp creates a new chirp and saves it to disk.
+// A nil publish_at publishes the chirp right away; otherwise the chirp
+// is returned by GetDueScheduledChirps once publish_at has passed.
+// Every chirp counts against its author for chirpRateWindow, even once
+// deleted, and ErrChirpRateLimited is returned once max have been posted.
+func (db *DB) CreateChirp(ctx context.Context, author_id int, body string, publish_at *time.Time, max int) (Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateChirp")
+	defer span.End()
 
-	chirp := Chirp{
-		Id:       uniqueId,
-		AuthorId: author_id,
-		Body:     body,
-	}
+	chirp := Chirp{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		pruneChirpCreations(*dbStructure, now.Add(-chirpRateWindow))
+		if len(dbStructure.ChirpCreations[author_id]) >= max {
+			return ErrChirpRateLimited
+		}
 
-	dbStructure.Chirps[chirp.Id] = chirp
+		uniqueId := nextId(dbStructure.Chirps)
 
-	err = db.writeDB(dbStructure)
+		chirp = Chirp{
+			Id:        uniqueId,
+			AuthorId:  author_id,
+			Body:      body,
+			CreatedAt: now,
+			PublishAt: publish_at,
+		}
+
+		dbStructure.Chirps[chirp.Id] = chirp
+		dbStructure.ChirpCreations[author_id] = append(dbStructure.ChirpCreations[author_id], now)
+		if publish_at != nil {
+			dbStructure.ScheduledChirps[chirp.Id] = *publish_at
+		}
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -36,15 +76,23 @@ func (db *DB) CreateChirp(author_id int, body string) (Chirp, error) {
 	return chirp, nil
 }
 
-// GetChirps returns all chirps in the database
-func (db *DB) GetChirps(author_id int, sort_reverse bool) ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+// GetChirps returns all chirps in the database that viewer_id may see.
+// Pass -1 as viewer_id for anonymous callers.
+func (db *DB) GetChirps(ctx context.Context, author_id, viewer_id int, sort_reverse bool) ([]Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetChirps")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
 	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
 	for _, chirp := range dbStructure.Chirps {
+		if !chirp.visibleTo(viewer_id, now) {
+			continue
+		}
 		if author_id == -1 {
 			chirps = append(chirps, chirp)
 		} else {
@@ -63,39 +111,140 @@ func (db *DB) GetChirps(author_id int, sort_reverse bool) ([]Chirp, error) {
 	return chirps, nil
 }
 
-// GetChirpsById returns chirp with matching id in the database
-func (db *DB) GetChirpById(i int) (Chirp, error) {
+// GetChirpsById returns chirp with matching id in the database,
+// if viewer_id may see it
+func (db *DB) GetChirpById(ctx context.Context, i, viewer_id int) (Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetChirpById")
+	defer span.End()
+
 	chirp := Chirp{}
-	dbStructure, err := db.loadDB()
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return chirp, err
 	}
 
 	chirp, ok := dbStructure.Chirps[i]
-	if !ok {
-		return chirp, errors.New("Chirp not found")
+	if !ok || !chirp.visibleTo(viewer_id, time.Now()) {
+		return Chirp{}, errors.New("Chirp not found")
 	}
 
 	return chirp, nil
 }
 
-// DeleteChirpById deletes chirp with matching id in the database
-func (db *DB) DeleteChirpById(i int) error {
-	dbStructure, err := db.loadDB()
+// GetChirpCreationsSince returns when an author created each chirp since
+// a time, oldest first, including chirps since deleted. Only creations
+// within chirpRateWindow are kept.
+func (db *DB) GetChirpCreationsSince(ctx context.Context, author_id int, since time.Time) ([]time.Time, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetChirpCreationsSince")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	created := make([]time.Time, 0)
+	for _, created_at := range dbStructure.ChirpCreations[author_id] {
+		if !created_at.Before(since) {
+			created = append(created, created_at)
+		}
+	}
+
+	return created, nil
+}
+
+// pruneChirpCreations forgets chirp creations from before since.
+// Creations are appended in order, so each author's list stays sorted.
+func pruneChirpCreations(dbStructure DBStructure, since time.Time) {
+	for author_id, created := range dbStructure.ChirpCreations {
+		kept := sort.Search(len(created), func(i int) bool { return !created[i].Before(since) })
+		if kept == len(created) {
+			delete(dbStructure.ChirpCreations, author_id)
+		} else if kept > 0 {
+			dbStructure.ChirpCreations[author_id] = created[kept:]
+		}
 	}
+}
+
+// UpdateChirpBody replaces the body of a chirp and marks it as edited
+func (db *DB) UpdateChirpBody(ctx context.Context, i int, body string) (Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateChirpBody")
+	defer span.End()
 
-	_, ok := dbStructure.Chirps[i]
-	if !ok {
-		return errors.New("Chirp not found")
+	chirp := Chirp{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		stored, ok := dbStructure.Chirps[i]
+		if !ok {
+			return errors.New("Chirp not found")
+		}
+
+		edited_at := time.Now().UTC()
+		chirp = stored
+		chirp.Body = body
+		chirp.EditedAt = &edited_at
+		dbStructure.Chirps[i] = chirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
-	delete(dbStructure.Chirps, i)
 
-	err = db.writeDB(dbStructure)
+	return chirp, nil
+}
+
+// DeleteChirpById deletes chirp with matching id in the database
+func (db *DB) DeleteChirpById(ctx context.Context, i int) error {
+	ctx, span := tracer.Start(ctx, "DB.DeleteChirpById")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.Chirps[i]
+		if !ok {
+			return errors.New("Chirp not found")
+		}
+
+		delete(dbStructure.Chirps, i)
+		delete(dbStructure.ScheduledChirps, i)
+		return nil
+	})
+}
+
+// GetDueScheduledChirps returns the scheduled chirps published by now
+// that haven't been marked with MarkScheduledChirpPublished, oldest first
+func (db *DB) GetDueScheduledChirps(ctx context.Context, now time.Time) ([]Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetDueScheduledChirps")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	chirps := make([]Chirp, 0)
+	for id, publish_at := range dbStructure.ScheduledChirps {
+		chirp, ok := dbStructure.Chirps[id]
+		if ok && !now.Before(publish_at) {
+			chirps = append(chirps, chirp)
+		}
 	}
 
-	return nil
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
+
+	return chirps, nil
+}
+
+// MarkScheduledChirpPublished records that the publication of a
+// scheduled chirp has been handled
+func (db *DB) MarkScheduledChirpPublished(ctx context.Context, i int) error {
+	ctx, span := tracer.Start(ctx, "DB.MarkScheduledChirpPublished")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.ScheduledChirps[i]; !ok {
+			return errNoChanges
+		}
+
+		delete(dbStructure.ScheduledChirps, i)
+		return nil
+	})
 }
@@ -1,21 +1,67 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"flag"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/Hien-Trinh/chirpy/internal/database")
+
+// ErrClosed is returned by every operation on a closed database
+var ErrClosed = errors.New("database is closed")
+
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path   string
+	mux    *sync.RWMutex
+	closed bool
+
+	// Set by Instrument
+	operationDuration *metrics.HistogramVec
+	fileSize          *metrics.Gauge
 }
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
+	Chirps map[int]Chirp `json:"chirps"`
+	// ScheduledChirps maps scheduled chirps to their publish time until
+	// their chirp.created event is sent
+	ScheduledChirps map[int]time.Time `json:"scheduled_chirps"`
+	// ChirpCreations maps authors to when they recently created chirps,
+	// so deleting a chirp doesn't free up rate limit
+	ChirpCreations map[int][]time.Time `json:"chirp_creations"`
+
 	Users         map[int]User         `json:"users"`
 	RefreshTokens map[int]RefreshToken `json:"refresh_tokens"`
+	UserTokens    map[int]UserToken    `json:"user_tokens"`
+
+	FailedLogins   map[int]FailedLogin      `json:"failed_logins"`
+	LoginThrottles map[string]LoginThrottle `json:"login_throttles"`
+
+	Identities      map[int]Identity       `json:"identities"`
+	OIDCLoginStates map[int]OIDCLoginState `json:"oidc_login_states"`
+
+	PersonalAccessTokens map[int]PersonalAccessToken `json:"personal_access_tokens"`
+
+	WebhookEvents map[int]WebhookEvent `json:"webhook_events"`
+	Subscriptions map[int]Subscription `json:"subscriptions"`
+
+	WebhookEndpoints  map[int]WebhookEndpoint `json:"webhook_endpoints"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhook_deliveries"`
+
+	// RefreshTokenIndex maps refresh token digests to refresh token ids
+	RefreshTokenIndex map[string]int `json:"refresh_token_index"`
+	// PersonalAccessTokenIndex maps personal access token digests to their ids
+	PersonalAccessTokenIndex map[string]int `json:"personal_access_token_index"`
 }
 
 // NewDB creates a new database connection
@@ -26,7 +72,15 @@ func NewDB(path string) (*DB, error) {
 		mux:  &sync.RWMutex{},
 	}
 
-	err := db.ensureDB()
+	// Opening the database isn't part of any request
+	ctx := context.Background()
+
+	err := db.ensureDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.migrate(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -34,54 +88,344 @@ func NewDB(path string) (*DB, error) {
 	return db, nil
 }
 
+// Instrument records how long reads and writes of the database file
+// take, and how large the file is, in registry
+func (db *DB) Instrument(registry *metrics.Registry) {
+	db.operationDuration = registry.NewHistogramVec(
+		"chirpy_db_operation_duration_seconds",
+		"Time spent reading or writing the database file.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		"operation",
+	)
+	db.fileSize = registry.NewGauge(
+		"chirpy_db_file_size_bytes",
+		"Size of the database file after the last read or write.",
+	)
+}
+
+// observe records an operation on the database file that started at start
+func (db *DB) observe(operation string, start time.Time, size int) {
+	if db.operationDuration == nil {
+		return
+	}
+	db.operationDuration.With(operation).Observe(time.Since(start).Seconds())
+	db.fileSize.Set(float64(size))
+}
+
+// Close marks the database as closed, so every later operation fails
+// with ErrClosed. A write already holding the lock finishes first, but
+// callers must stop their own operations before closing.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	db.closed = true
+	return nil
+}
+
 // ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
+func (db *DB) ensureDB(ctx context.Context) error {
 	_, err := os.ReadFile(db.path)
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
-	if errors.Is(err, os.ErrNotExist) || *dbg {
-		dbStructure := DBStructure{
-			Chirps:        make(map[int]Chirp),
-			Users:         make(map[int]User),
-			RefreshTokens: make(map[int]RefreshToken),
-		}
-		return db.writeDB(dbStructure)
+	if errors.Is(err, os.ErrNotExist) {
+		return db.ResetDB(ctx)
 	}
 
 	return err
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
+// ResetDB replaces the database file with an empty database
+func (db *DB) ResetDB(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "DB.ResetDB")
+	defer span.End()
+
+	dbStructure := DBStructure{
+		Chirps:          make(map[int]Chirp),
+		ScheduledChirps: make(map[int]time.Time),
+		ChirpCreations:  make(map[int][]time.Time),
+
+		Users:         make(map[int]User),
+		RefreshTokens: make(map[int]RefreshToken),
+		UserTokens:    make(map[int]UserToken),
+
+		FailedLogins:   make(map[int]FailedLogin),
+		LoginThrottles: make(map[string]LoginThrottle),
+
+		Identities:      make(map[int]Identity),
+		OIDCLoginStates: make(map[int]OIDCLoginState),
+
+		PersonalAccessTokens: make(map[int]PersonalAccessToken),
+
+		WebhookEvents: make(map[int]WebhookEvent),
+		Subscriptions: make(map[int]Subscription),
+
+		WebhookEndpoints:  make(map[int]WebhookEndpoint),
+		WebhookDeliveries: make(map[int]WebhookDelivery),
+
+		RefreshTokenIndex:        make(map[string]int),
+		PersonalAccessTokenIndex: make(map[string]int),
+	}
+	return db.writeDB(ctx, dbStructure)
+}
+
+// migrate upgrades rows written by older versions of Chirpy
+func (db *DB) migrate(ctx context.Context) error {
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		migrateRows(*dbStructure)
+		return nil
+	})
+}
+
+func migrateRows(dbStructure DBStructure) {
+	// Refresh tokens used to be stored in plaintext with no digest;
+	// they can't be looked up anymore, so they are invalidated
+	for id, refresh_token := range dbStructure.RefreshTokens {
+		if refresh_token.TokenHash == "" {
+			deleteRefreshToken(dbStructure, id)
+		}
+	}
+
+	// Chirpy Red used to be a flag on the user; members from back
+	// then get an open-ended subscription
+	for id, user := range dbStructure.Users {
+		_, ok := activeSubscription(dbStructure, id, PlanChirpyRed)
+		if user.IsChirpyRed && !ok {
+			subscription := Subscription{
+				Id:        nextId(dbStructure.Subscriptions),
+				UserID:    id,
+				Plan:      PlanChirpyRed,
+				Status:    SubscriptionActive,
+				StartedAt: user.CreatedAt,
+			}
+			dbStructure.Subscriptions[subscription.Id] = subscription
+		}
+	}
+}
+
+// loadDB reads the database file into memory.
+// Changes must be saved with update, never by passing the result to writeDB.
+func (db *DB) loadDB(ctx context.Context) (DBStructure, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
+	return db.read(ctx)
+}
+
+// writeDB replaces the whole database with dbStructure
+func (db *DB) writeDB(ctx context.Context, dbStructure DBStructure) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.write(ctx, dbStructure)
+}
+
+// errNoChanges tells update that fn left the database as it was
+var errNoChanges = errors.New("no changes")
+
+// update loads the database, lets fn change it and saves the result,
+// holding the write lock throughout so that no other write can slip in
+// between. Nothing is saved when fn returns an error; errNoChanges skips
+// the write without failing.
+func (db *DB) update(ctx context.Context, fn func(dbStructure *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&dbStructure)
+	if errors.Is(err, errNoChanges) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.write(ctx, dbStructure)
+}
+
+// read reads the database file; the caller holds db.mux
+func (db *DB) read(ctx context.Context) (DBStructure, error) {
+	_, span := tracer.Start(ctx, "DB.loadDB")
+	defer span.End()
+
 	dbStructure := DBStructure{}
+	if db.closed {
+		return dbStructure, spanError(span, ErrClosed)
+	}
 
+	start := time.Now()
 	file, err := os.ReadFile(db.path)
 	if err != nil {
-		return dbStructure, err
+		return dbStructure, spanError(span, err)
 	}
+	defer db.observe("read", start, len(file))
+	span.SetAttributes(attribute.Int("db.file.size", len(file)))
 
 	err = json.Unmarshal(file, &dbStructure)
 	if err != nil {
-		return dbStructure, err
+		return dbStructure, spanError(span, err)
+	}
+
+	// Tables added after the file was created are missing from it
+	if dbStructure.ScheduledChirps == nil {
+		dbStructure.ScheduledChirps = make(map[int]time.Time)
+	}
+	if dbStructure.ChirpCreations == nil {
+		dbStructure.ChirpCreations = make(map[int][]time.Time)
+		for _, chirp := range dbStructure.Chirps {
+			dbStructure.ChirpCreations[chirp.AuthorId] = append(dbStructure.ChirpCreations[chirp.AuthorId], chirp.CreatedAt)
+		}
+		for _, created := range dbStructure.ChirpCreations {
+			sort.Slice(created, func(i, j int) bool { return created[i].Before(created[j]) })
+		}
+		pruneChirpCreations(dbStructure, time.Now().UTC().Add(-chirpRateWindow))
+	}
+	if dbStructure.UserTokens == nil {
+		dbStructure.UserTokens = make(map[int]UserToken)
+	}
+	if dbStructure.FailedLogins == nil {
+		dbStructure.FailedLogins = make(map[int]FailedLogin)
+	}
+	if dbStructure.LoginThrottles == nil {
+		dbStructure.LoginThrottles = make(map[string]LoginThrottle)
+	}
+	if dbStructure.Identities == nil {
+		dbStructure.Identities = make(map[int]Identity)
+	}
+	if dbStructure.OIDCLoginStates == nil {
+		dbStructure.OIDCLoginStates = make(map[int]OIDCLoginState)
+	}
+	if dbStructure.PersonalAccessTokens == nil {
+		dbStructure.PersonalAccessTokens = make(map[int]PersonalAccessToken)
+	}
+	if dbStructure.WebhookEvents == nil {
+		dbStructure.WebhookEvents = make(map[int]WebhookEvent)
+	}
+	if dbStructure.WebhookEndpoints == nil {
+		dbStructure.WebhookEndpoints = make(map[int]WebhookEndpoint)
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = make(map[int]WebhookDelivery)
+	}
+	if dbStructure.Subscriptions == nil {
+		// Left to migrate, which turns IsChirpyRed into subscriptions
+		dbStructure.Subscriptions = make(map[int]Subscription)
+	} else {
+		deriveChirpyRed(dbStructure)
+	}
+	if dbStructure.RefreshTokenIndex == nil {
+		dbStructure.RefreshTokenIndex = make(map[string]int)
+		for id, refresh_token := range dbStructure.RefreshTokens {
+			dbStructure.RefreshTokenIndex[refresh_token.TokenHash] = id
+		}
+	}
+	if dbStructure.PersonalAccessTokenIndex == nil {
+		dbStructure.PersonalAccessTokenIndex = make(map[string]int)
+		for id, personal_access_token := range dbStructure.PersonalAccessTokens {
+			dbStructure.PersonalAccessTokenIndex[personal_access_token.TokenHash] = id
+		}
 	}
 
 	return dbStructure, nil
 }
 
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// write writes the database file to disk; the caller holds db.mux for writing.
+// The file is replaced in one step, so a crash mid-write leaves the
+// previous version intact.
+func (db *DB) write(ctx context.Context, dbStructure DBStructure) error {
+	_, span := tracer.Start(ctx, "DB.writeDB")
+	defer span.End()
+
+	if db.closed {
+		return spanError(span, ErrClosed)
+	}
 
+	start := time.Now()
 	file, err := json.MarshalIndent(dbStructure, "", "  ")
+	if err != nil {
+		return spanError(span, err)
+	}
+	defer db.observe("write", start, len(file))
+	span.SetAttributes(attribute.Int("db.file.size", len(file)))
+
+	err = writeFileAtomic(db.path, file, 0644)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it
+// and renames it over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	// Harmless once the rename succeeded
+	defer os.Remove(tmp.Name())
 
-	err = os.WriteFile("database.json", file, 0644)
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
 
+	return os.Rename(tmp.Name(), path)
+}
+
+// spanError marks span as failed with err, and returns err
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
 	return err
 }
+
+// nextId returns an id greater than every id in a table,
+// so ids of deleted rows are never handed out again
+func nextId[T any](table map[int]T) int {
+	uniqueId := 1
+	for id := range table {
+		if id >= uniqueId {
+			uniqueId = id + 1
+		}
+	}
+
+	return uniqueId
+}
+
+// pruneOldest deletes the rows with the lowest ids until at most max are left.
+// Ids can have gaps, since rows are also deleted for other reasons.
+func pruneOldest[T any](table map[int]T, max int) {
+	pruneOldestWhere(table, max, func(T) bool { return true })
+}
+
+// pruneOldestWhere is pruneOldest for only the rows prunable accepts;
+// other rows are neither counted nor deleted
+func pruneOldestWhere[T any](table map[int]T, max int, prunable func(row T) bool) {
+	ids := make([]int, 0, len(table))
+	for id, row := range table {
+		if prunable(row) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) <= max {
+		return
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids[:len(ids)-max] {
+		delete(table, id)
+	}
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrIdentityLinked is returned when an external identity already
+// belongs to a user
+var ErrIdentityLinked = errors.New("identity already linked")
+
+// Identity links an account at an external identity provider to a user
+type Identity struct {
+	Id        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCLoginState is a login with an external identity provider that
+// has been started but not finished. Only a digest of the state is stored.
+type OIDCLoginState struct {
+	Id           int       `json:"id"`
+	Provider     string    `json:"provider"`
+	StateHash    string    `json:"state_hash"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// CreateIdentity links the subject at provider to a user and saves it to disk
+func (db *DB) CreateIdentity(ctx context.Context, user_id int, provider, subject, email string) (Identity, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateIdentity")
+	defer span.End()
+
+	identity := Identity{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[user_id]; !ok {
+			return errors.New("User not found")
+		}
+		for _, linked := range dbStructure.Identities {
+			if linked.Provider == provider && linked.Subject == subject {
+				return ErrIdentityLinked
+			}
+		}
+
+		identity = Identity{
+			Id:        nextId(dbStructure.Identities),
+			UserID:    user_id,
+			Provider:  provider,
+			Subject:   subject,
+			Email:     email,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		dbStructure.Identities[identity.Id] = identity
+		return nil
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return identity, nil
+}
+
+// GetIdentity returns the identity of subject at provider
+func (db *DB) GetIdentity(ctx context.Context, provider, subject string) (Identity, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetIdentity")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	for _, identity := range dbStructure.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+
+	return Identity{}, errors.New("identity not found")
+}
+
+// GetIdentitiesByUser returns the identities linked to a user
+func (db *DB) GetIdentitiesByUser(ctx context.Context, user_id int) ([]Identity, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetIdentitiesByUser")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := make([]Identity, 0)
+	for _, identity := range dbStructure.Identities {
+		if identity.UserID == user_id {
+			identities = append(identities, identity)
+		}
+	}
+
+	return identities, nil
+}
+
+// CreateOIDCLoginState saves a started login and drops expired ones
+func (db *DB) CreateOIDCLoginState(ctx context.Context, provider, state_hash, nonce, code_verifier string, expires_at time.Time) (OIDCLoginState, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateOIDCLoginState")
+	defer span.End()
+
+	login_state := OIDCLoginState{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for id, started := range dbStructure.OIDCLoginStates {
+			if started.ExpiresAt.Before(now) {
+				delete(dbStructure.OIDCLoginStates, id)
+			}
+		}
+
+		login_state = OIDCLoginState{
+			Id:           nextId(dbStructure.OIDCLoginStates),
+			Provider:     provider,
+			StateHash:    state_hash,
+			Nonce:        nonce,
+			CodeVerifier: code_verifier,
+			ExpiresAt:    expires_at,
+		}
+
+		dbStructure.OIDCLoginStates[login_state.Id] = login_state
+		return nil
+	})
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+
+	return login_state, nil
+}
+
+// ConsumeOIDCLoginState looks up a started login by digest and deletes it,
+// so that every state can only be used once
+func (db *DB) ConsumeOIDCLoginState(ctx context.Context, provider, state_hash string) (OIDCLoginState, error) {
+	ctx, span := tracer.Start(ctx, "DB.ConsumeOIDCLoginState")
+	defer span.End()
+
+	login_state := OIDCLoginState{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for id, started := range dbStructure.OIDCLoginStates {
+			if started.Provider != provider || started.StateHash != state_hash {
+				continue
+			}
+
+			delete(dbStructure.OIDCLoginStates, id)
+			login_state = started
+			return nil
+		}
+
+		return errors.New("login not found")
+	})
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+
+	if login_state.ExpiresAt.Before(time.Now().UTC()) {
+		return OIDCLoginState{}, errors.New("login has expired")
+	}
+
+	return login_state, nil
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// maxFailedLogins is how many failed login records are kept for auditing
+const maxFailedLogins = 10000
+
+// FailedLogin is an audit record of a rejected login attempt
+type FailedLogin struct {
+	Id        int       `json:"id"`
+	Email     string    `json:"email"`
+	UserID    int       `json:"user_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `json:"reason"`
+	At        time.Time `json:"at"`
+}
+
+// LoginThrottle counts recent failed logins for one key,
+// such as an email address or an IP address
+type LoginThrottle struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+}
+
+// GetLoginThrottles returns the throttles for keys.
+// Keys without failures are missing from the result.
+func (db *DB) GetLoginThrottles(ctx context.Context, keys ...string) (map[string]LoginThrottle, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetLoginThrottles")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	throttles := make(map[string]LoginThrottle, len(keys))
+	for _, key := range keys {
+		throttle, ok := dbStructure.LoginThrottles[key]
+		if ok {
+			throttles[key] = throttle
+		}
+	}
+
+	return throttles, nil
+}
+
+// LoginLimit returns until when a throttle locks its key out
+type LoginLimit func(throttle LoginThrottle) time.Time
+
+// ReserveLoginAttempt counts a login attempt as a failure against each
+// key of limits before its outcome is known, unless a key is locked out.
+// Checking and counting happen in one update, so concurrent guesses
+// can't all get past a lockout; ReleaseLoginAttempt takes the count back
+// once the attempt succeeds. Counts whose last failure is before
+// reset_before start again from zero.
+// It returns until when the attempt is locked out, or the zero time
+// if it was counted.
+func (db *DB) ReserveLoginAttempt(ctx context.Context, limits map[string]LoginLimit, at, reset_before time.Time) (time.Time, error) {
+	ctx, span := tracer.Start(ctx, "DB.ReserveLoginAttempt")
+	defer span.End()
+
+	locked_until := time.Time{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for key, throttle := range dbStructure.LoginThrottles {
+			if throttle.LastFailureAt.Before(reset_before) {
+				delete(dbStructure.LoginThrottles, key)
+			}
+		}
+
+		for key, limit := range limits {
+			key_locked_until := limit(dbStructure.LoginThrottles[key])
+			if key_locked_until.After(at) && key_locked_until.After(locked_until) {
+				locked_until = key_locked_until
+			}
+		}
+		if !locked_until.IsZero() {
+			// Save the pruning anyway
+			return nil
+		}
+
+		for key := range limits {
+			throttle, ok := dbStructure.LoginThrottles[key]
+			if !ok {
+				throttle = LoginThrottle{Key: key}
+			}
+			throttle.Failures++
+			throttle.LastFailureAt = at
+			dbStructure.LoginThrottles[key] = throttle
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return locked_until, nil
+}
+
+// ReleaseLoginAttempt takes back an attempt counted by ReserveLoginAttempt
+func (db *DB) ReleaseLoginAttempt(ctx context.Context, keys []string) error {
+	ctx, span := tracer.Start(ctx, "DB.ReleaseLoginAttempt")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		changed := false
+		for _, key := range keys {
+			throttle, ok := dbStructure.LoginThrottles[key]
+			if !ok {
+				continue
+			}
+
+			throttle.Failures--
+			if throttle.Failures > 0 {
+				dbStructure.LoginThrottles[key] = throttle
+			} else {
+				delete(dbStructure.LoginThrottles, key)
+			}
+			changed = true
+		}
+		if !changed {
+			return errNoChanges
+		}
+		return nil
+	})
+}
+
+// RecordFailedLogin saves an audit record of a failed login. The failure
+// itself was already counted when the attempt was reserved.
+func (db *DB) RecordFailedLogin(ctx context.Context, attempt FailedLogin) error {
+	ctx, span := tracer.Start(ctx, "DB.RecordFailedLogin")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		attempt.Id = nextId(dbStructure.FailedLogins)
+		dbStructure.FailedLogins[attempt.Id] = attempt
+		pruneOldest(dbStructure.FailedLogins, maxFailedLogins)
+		return nil
+	})
+}
+
+// ClearLoginThrottle forgets the failures counted against a key
+func (db *DB) ClearLoginThrottle(ctx context.Context, key string) error {
+	ctx, span := tracer.Start(ctx, "DB.ClearLoginThrottle")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.LoginThrottles[key]
+		if !ok {
+			return errNoChanges
+		}
+
+		delete(dbStructure.LoginThrottles, key)
+		return nil
+	})
+}
+
+// GetFailedLogins returns the most recent failed logins, newest first
+func (db *DB) GetFailedLogins(ctx context.Context, limit int) ([]FailedLogin, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetFailedLogins")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	failed_logins := make([]FailedLogin, 0, len(dbStructure.FailedLogins))
+	for _, failed_login := range dbStructure.FailedLogins {
+		failed_logins = append(failed_logins, failed_login)
+	}
+
+	sort.Slice(failed_logins, func(i, j int) bool { return failed_logins[i].Id > failed_logins[j].Id })
+	if len(failed_logins) > limit {
+		failed_logins = failed_logins[:limit]
+	}
+
+	return failed_logins, nil
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPruneOldest(t *testing.T) {
+	table := map[int]string{1: "a", 2: "b", 5: "c", 9: "d", 10: "e"}
+
+	pruneOldest(table, 3)
+
+	if len(table) != 3 {
+		t.Fatalf("%d rows left, want 3", len(table))
+	}
+	for _, id := range []int{5, 9, 10} {
+		if _, ok := table[id]; !ok {
+			t.Errorf("row %d was pruned, want the oldest pruned first", id)
+		}
+	}
+
+	pruneOldest(table, 5)
+	if len(table) != 3 {
+		t.Fatalf("pruning below the cap deleted rows")
+	}
+}
+
+func TestRecordFailedLoginKeepsCapWithGaps(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// Every other id is missing, as if those rows had been deleted
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for i := 0; i < maxFailedLogins; i++ {
+			id := 2*i + 1
+			dbStructure.FailedLogins[id] = FailedLogin{Id: id}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("seeding failed logins: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = db.RecordFailedLogin(ctx, FailedLogin{Email: "user@example.com", At: time.Now()})
+		if err != nil {
+			t.Fatalf("RecordFailedLogin: %v", err)
+		}
+	}
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+	if len(dbStructure.FailedLogins) != maxFailedLogins {
+		t.Fatalf("%d failed logins kept, want %d", len(dbStructure.FailedLogins), maxFailedLogins)
+	}
+	for _, id := range []int{1, 3, 5} {
+		if _, ok := dbStructure.FailedLogins[id]; ok {
+			t.Errorf("failed login %d survived, want the oldest pruned", id)
+		}
+	}
+}
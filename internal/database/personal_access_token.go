@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTooManyPersonalAccessTokens is returned when a user already has
+// as many personal access tokens as they may
+var ErrTooManyPersonalAccessTokens = errors.New("too many personal access tokens")
+
+// Scope limits what a personal access token may do
+type Scope string
+
+const (
+	ScopeChirpsRead   Scope = "chirps:read"
+	ScopeChirpsWrite  Scope = "chirps:write"
+	ScopeProfileWrite Scope = "profile:write"
+)
+
+// Scopes lists every scope a personal access token can be granted
+var Scopes = []Scope{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite}
+
+// Valid reports whether s is a known scope
+func (s Scope) Valid() bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// PersonalAccessToken is a long-lived token a user mints for scripts and
+// integrations. Only a digest of the token is stored.
+type PersonalAccessToken struct {
+	Id         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Hint       string    `json:"hint"`
+	TokenHash  string    `json:"token_hash"`
+	Scopes     []Scope   `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// Expired reports whether the token has passed its expiry
+func (t PersonalAccessToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && t.ExpiresAt.Before(time.Now().UTC())
+}
+
+// CreatePersonalAccessToken creates a new personal access token and saves it to disk,
+// unless the user already has max tokens. A zero expires_at means the token never expires.
+func (db *DB) CreatePersonalAccessToken(ctx context.Context, user_id int, name, hint, token_hash string, scopes []Scope, expires_at time.Time, max int) (PersonalAccessToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreatePersonalAccessToken")
+	defer span.End()
+
+	personal_access_token := PersonalAccessToken{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[user_id]; !ok {
+			return errors.New("User not found")
+		}
+
+		count := 0
+		for _, existing := range dbStructure.PersonalAccessTokens {
+			if existing.UserID == user_id {
+				count++
+			}
+		}
+		if count >= max {
+			return ErrTooManyPersonalAccessTokens
+		}
+
+		personal_access_token = PersonalAccessToken{
+			Id:        nextId(dbStructure.PersonalAccessTokens),
+			UserID:    user_id,
+			Name:      name,
+			Hint:      hint,
+			TokenHash: token_hash,
+			Scopes:    scopes,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expires_at,
+		}
+
+		putPersonalAccessToken(*dbStructure, personal_access_token)
+		return nil
+	})
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	return personal_access_token, nil
+}
+
+// GetPersonalAccessTokensByUser returns the personal access tokens of a user
+func (db *DB) GetPersonalAccessTokensByUser(ctx context.Context, user_id int) ([]PersonalAccessToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetPersonalAccessTokensByUser")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	personal_access_tokens := make([]PersonalAccessToken, 0)
+	for _, personal_access_token := range dbStructure.PersonalAccessTokens {
+		if personal_access_token.UserID == user_id {
+			personal_access_tokens = append(personal_access_tokens, personal_access_token)
+		}
+	}
+
+	return personal_access_tokens, nil
+}
+
+// GetPersonalAccessTokenByHash returns the personal access token with matching digest
+func (db *DB) GetPersonalAccessTokenByHash(ctx context.Context, token_hash string) (PersonalAccessToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetPersonalAccessTokenByHash")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	personal_access_token, ok := dbStructure.PersonalAccessTokens[dbStructure.PersonalAccessTokenIndex[token_hash]]
+	if !ok {
+		return PersonalAccessToken{}, errors.New("token not found")
+	}
+
+	return personal_access_token, nil
+}
+
+// TouchPersonalAccessToken records that a personal access token was used
+func (db *DB) TouchPersonalAccessToken(ctx context.Context, i int, used_at time.Time) error {
+	ctx, span := tracer.Start(ctx, "DB.TouchPersonalAccessToken")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		personal_access_token, ok := dbStructure.PersonalAccessTokens[i]
+		if !ok {
+			return errors.New("token not found")
+		}
+
+		personal_access_token.LastUsedAt = used_at
+		dbStructure.PersonalAccessTokens[i] = personal_access_token
+		return nil
+	})
+}
+
+// DeletePersonalAccessToken revokes a personal access token of a user
+func (db *DB) DeletePersonalAccessToken(ctx context.Context, user_id, i int) error {
+	ctx, span := tracer.Start(ctx, "DB.DeletePersonalAccessToken")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		personal_access_token, ok := dbStructure.PersonalAccessTokens[i]
+		if !ok || personal_access_token.UserID != user_id {
+			return errors.New("token not found")
+		}
+
+		deletePersonalAccessToken(*dbStructure, i)
+		return nil
+	})
+}
+
+// putPersonalAccessToken stores a personal access token and indexes it by digest
+func putPersonalAccessToken(dbStructure DBStructure, personal_access_token PersonalAccessToken) {
+	dbStructure.PersonalAccessTokens[personal_access_token.Id] = personal_access_token
+	dbStructure.PersonalAccessTokenIndex[personal_access_token.TokenHash] = personal_access_token.Id
+}
+
+// deletePersonalAccessToken removes a personal access token and its index entry
+func deletePersonalAccessToken(dbStructure DBStructure, id int) {
+	delete(dbStructure.PersonalAccessTokenIndex, dbStructure.PersonalAccessTokens[id].TokenHash)
+	delete(dbStructure.PersonalAccessTokens, id)
+}
@@ -1,37 +1,58 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"sort"
 	"time"
 )
 
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again
+var ErrRefreshTokenReused = errors.New("refresh token has already been used")
+
+// RefreshToken is one link in a chain of rotated refresh tokens.
+// Every token issued from the same login shares a FamilyId, and only
+// the latest one in a family has a zero RotatedAt.
+// Only a digest of the token is stored.
 type RefreshToken struct {
-	Id        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
+	Id         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	FamilyId   int       `json:"family_id"`
+	TokenHash  string    `json:"token_hash"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RotatedAt  time.Time `json:"rotated_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
 }
 
-// CreateRefreshToken creates a new refresh token and saves it to disk
-func (db *DB) CreateRefreshToken(user_id int, refresh_token_string string, refresh_token_expires_at time.Time) (RefreshToken, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return RefreshToken{}, err
-	}
-
-	uniqueId := len(dbStructure.RefreshTokens) + 1
-
-	refresh_token := RefreshToken{
-		Id:        uniqueId,
-		UserID:    user_id,
-		Token:     refresh_token_string,
-		ExpiresAt: refresh_token_expires_at,
-	}
-
-	dbStructure.RefreshTokens[refresh_token.Id] = refresh_token
+// CreateRefreshToken creates a new refresh token starting a new family and saves it to disk
+func (db *DB) CreateRefreshToken(ctx context.Context, user_id int, token_hash string, refresh_token_expires_at time.Time, user_agent, ip string) (RefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateRefreshToken")
+	defer span.End()
+
+	refresh_token := RefreshToken{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		uniqueId := nextId(dbStructure.RefreshTokens)
+		now := time.Now().UTC()
+
+		refresh_token = RefreshToken{
+			Id:         uniqueId,
+			UserID:     user_id,
+			FamilyId:   uniqueId,
+			TokenHash:  token_hash,
+			ExpiresAt:  refresh_token_expires_at,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			UserAgent:  user_agent,
+			IP:         ip,
+		}
 
-	err = db.writeDB(dbStructure)
+		putRefreshToken(*dbStructure, refresh_token)
+		return nil
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
@@ -40,8 +61,11 @@ func (db *DB) CreateRefreshToken(user_id int, refresh_token_string string, refre
 }
 
 // GetRefreshTokens returns all refresh tokens in the database
-func (db *DB) GetRefreshTokens() ([]RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetRefreshTokens(ctx context.Context) ([]RefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetRefreshTokens")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -56,43 +80,171 @@ func (db *DB) GetRefreshTokens() ([]RefreshToken, error) {
 	return refresh_tokens, nil
 }
 
-// GetRefreshTokensByToken returns a refresh token by token
-func (db *DB) GetRefreshTokensByToken(token string) (RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+// GetSessionsByUser returns the current refresh token of every
+// unexpired family belonging to a user, most recently used first
+func (db *DB) GetSessionsByUser(ctx context.Context, user_id int) ([]RefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetSessionsByUser")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return RefreshToken{}, err
+		return nil, err
 	}
 
+	now := time.Now().UTC()
+	sessions := make([]RefreshToken, 0)
 	for _, refresh_token := range dbStructure.RefreshTokens {
-		if refresh_token.Token == token {
-			if refresh_token.ExpiresAt.Before(time.Now().UTC()) {
-				return RefreshToken{}, errors.New("token has expired")
-			}
-			return refresh_token, nil
+		if refresh_token.UserID == user_id && refresh_token.RotatedAt.IsZero() && refresh_token.ExpiresAt.After(now) {
+			sessions = append(sessions, refresh_token)
 		}
 	}
 
-	return RefreshToken{}, errors.New("refresh token not found")
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+
+	return sessions, nil
 }
 
-// RevokeRefreshToken revokes a refresh token
-func (db *DB) RevokeRefreshToken(i int) error {
-	dbStructure, err := db.loadDB()
+// GetRefreshTokenByHash returns the current refresh token with matching digest
+func (db *DB) GetRefreshTokenByHash(ctx context.Context, token_hash string) (RefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetRefreshTokenByHash")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return err
+		return RefreshToken{}, err
 	}
 
-	_, ok := dbStructure.RefreshTokens[i]
-	if !ok {
-		return errors.New("refresh token not found")
+	refresh_token, ok := dbStructure.RefreshTokens[dbStructure.RefreshTokenIndex[token_hash]]
+	if !ok || !refresh_token.RotatedAt.IsZero() {
+		return RefreshToken{}, errors.New("refresh token not found")
 	}
 
-	delete(dbStructure.RefreshTokens, i)
+	if refresh_token.ExpiresAt.Before(time.Now().UTC()) {
+		return RefreshToken{}, errors.New("token has expired")
+	}
+
+	return refresh_token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family.
+// If the token was already rotated, the whole family is revoked and
+// ErrRefreshTokenReused is returned. The check and the rotation happen
+// under one lock, so of two concurrent uses of a token only one succeeds.
+func (db *DB) RotateRefreshToken(ctx context.Context, token_hash, new_token_hash, user_agent, ip string) (RefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.RotateRefreshToken")
+	defer span.End()
+
+	reused := false
+	new_refresh_token := RefreshToken{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for id, refresh_token := range dbStructure.RefreshTokens {
+			if refresh_token.ExpiresAt.Before(now) {
+				deleteRefreshToken(*dbStructure, id)
+			}
+		}
 
-	err = db.writeDB(dbStructure)
+		refresh_token, ok := dbStructure.RefreshTokens[dbStructure.RefreshTokenIndex[token_hash]]
+		if !ok {
+			return errors.New("refresh token not found")
+		}
+
+		if !refresh_token.RotatedAt.IsZero() {
+			// Saved, then reported once the revocation is on disk
+			revokeFamily(*dbStructure, refresh_token.FamilyId)
+			reused = true
+			return nil
+		}
+
+		refresh_token.RotatedAt = now
+		putRefreshToken(*dbStructure, refresh_token)
+
+		new_refresh_token = RefreshToken{
+			Id:         nextId(dbStructure.RefreshTokens),
+			UserID:     refresh_token.UserID,
+			FamilyId:   refresh_token.FamilyId,
+			TokenHash:  new_token_hash,
+			ExpiresAt:  refresh_token.ExpiresAt,
+			CreatedAt:  refresh_token.CreatedAt,
+			LastUsedAt: now,
+			UserAgent:  user_agent,
+			IP:         ip,
+		}
+		putRefreshToken(*dbStructure, new_refresh_token)
+		return nil
+	})
 	if err != nil {
-		return err
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+
+	return new_refresh_token, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token rotated from the same login
+func (db *DB) RevokeRefreshTokenFamily(ctx context.Context, family_id int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokeRefreshTokenFamily")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		revokeFamily(*dbStructure, family_id)
+		return nil
+	})
+}
+
+// RevokeRefreshToken revokes a refresh token
+func (db *DB) RevokeRefreshToken(ctx context.Context, i int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokeRefreshToken")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.RefreshTokens[i]
+		if !ok {
+			return errors.New("refresh token not found")
+		}
+
+		deleteRefreshToken(*dbStructure, i)
+		return nil
+	})
+}
+
+// RevokeRefreshTokensByUser revokes every refresh token belonging to a user
+func (db *DB) RevokeRefreshTokensByUser(ctx context.Context, user_id int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokeRefreshTokensByUser")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		revokeUserRefreshTokens(*dbStructure, user_id)
+		return nil
+	})
+}
+
+// putRefreshToken stores a refresh token and indexes it by digest
+func putRefreshToken(dbStructure DBStructure, refresh_token RefreshToken) {
+	dbStructure.RefreshTokens[refresh_token.Id] = refresh_token
+	dbStructure.RefreshTokenIndex[refresh_token.TokenHash] = refresh_token.Id
+}
+
+// deleteRefreshToken removes a refresh token and its index entry
+func deleteRefreshToken(dbStructure DBStructure, id int) {
+	delete(dbStructure.RefreshTokenIndex, dbStructure.RefreshTokens[id].TokenHash)
+	delete(dbStructure.RefreshTokens, id)
+}
+
+func revokeFamily(dbStructure DBStructure, family_id int) {
+	for id, refresh_token := range dbStructure.RefreshTokens {
+		if refresh_token.FamilyId == family_id {
+			deleteRefreshToken(dbStructure, id)
+		}
 	}
+}
 
-	return nil
+func revokeUserRefreshTokens(dbStructure DBStructure, user_id int) {
+	for id, refresh_token := range dbStructure.RefreshTokens {
+		if refresh_token.UserID == user_id {
+			deleteRefreshToken(dbStructure, id)
+		}
+	}
 }
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	return db
+}
+
+func TestRotateRefreshTokenReplay(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	_, err := db.CreateRefreshToken(ctx, 1, "a", time.Now().Add(time.Hour), "", "")
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+
+	_, err = db.RotateRefreshToken(ctx, "a", "b", "", "")
+	if err != nil {
+		t.Fatalf("first rotation: %v", err)
+	}
+
+	_, err = db.RotateRefreshToken(ctx, "a", "c", "", "")
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("replayed rotation: got %v, want ErrRefreshTokenReused", err)
+	}
+
+	// The replay revokes the token the first rotation issued
+	_, err = db.GetRefreshTokenByHash(ctx, "b")
+	if err == nil {
+		t.Fatal("token from the first rotation survived the replay")
+	}
+	_, err = db.RotateRefreshToken(ctx, "b", "d", "", "")
+	if err == nil {
+		t.Fatal("token from the first rotation can still be rotated")
+	}
+}
+
+func TestRotateRefreshTokenConcurrentReplay(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	_, err := db.CreateRefreshToken(ctx, 1, "a", time.Now().Add(time.Hour), "", "")
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+
+	const attempts = 20
+	errs := make([]error, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.RotateRefreshToken(ctx, "a", fmt.Sprintf("new-%d", i), "", "")
+		}(i)
+	}
+	wg.Wait()
+
+	// Once a replay has revoked the family, later attempts find no token
+	rotated, reused := 0, 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			rotated++
+		case errors.Is(err, ErrRefreshTokenReused):
+			reused++
+		}
+	}
+	if rotated != 1 {
+		t.Fatalf("%d attempts rotated the token, want exactly 1", rotated)
+	}
+	if reused == 0 {
+		t.Fatal("no attempt was reported as a replay")
+	}
+
+	// Every replay revoked the family, including the winner's new token
+	refresh_tokens, err := db.GetRefreshTokens(ctx)
+	if err != nil {
+		t.Fatalf("GetRefreshTokens: %v", err)
+	}
+	if len(refresh_tokens) != 0 {
+		t.Fatalf("%d refresh tokens left after the replay, want 0", len(refresh_tokens))
+	}
+}
@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+type SubscriptionPlan string
+
+const PlanChirpyRed SubscriptionPlan = "chirpy_red"
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive   SubscriptionStatus = "active"
+	SubscriptionCanceled SubscriptionStatus = "canceled"
+	SubscriptionExpired  SubscriptionStatus = "expired"
+)
+
+// Subscription is one paid membership of a user, from start to end.
+// A zero CurrentPeriodEnd means the period is open-ended; a zero
+// CancelAt means the subscription renews.
+type Subscription struct {
+	Id               int                `json:"id"`
+	UserID           int                `json:"user_id"`
+	Plan             SubscriptionPlan   `json:"plan"`
+	Status           SubscriptionStatus `json:"status"`
+	StartedAt        time.Time          `json:"started_at"`
+	CurrentPeriodEnd time.Time          `json:"current_period_end"`
+	CancelAt         time.Time          `json:"cancel_at"`
+	EndedAt          time.Time          `json:"ended_at"`
+}
+
+// Lapsed reports whether an active subscription has run past its
+// period or cancellation date and is waiting to be expired
+func (s Subscription) Lapsed(now time.Time) bool {
+	return (!s.CurrentPeriodEnd.IsZero() && !now.Before(s.CurrentPeriodEnd)) ||
+		(!s.CancelAt.IsZero() && !now.Before(s.CancelAt))
+}
+
+// entitled reports whether the subscription grants its plan at now
+func (s Subscription) entitled(now time.Time) bool {
+	return s.Status == SubscriptionActive && !s.Lapsed(now)
+}
+
+// StartSubscription starts a subscription to plan for a user, or renews the
+// active one until current_period_end, lifting any scheduled cancellation
+func (db *DB) StartSubscription(ctx context.Context, user_id int, plan SubscriptionPlan, current_period_end time.Time) (Subscription, error) {
+	ctx, span := tracer.Start(ctx, "DB.StartSubscription")
+	defer span.End()
+
+	subscription := Subscription{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[user_id]; !ok {
+			return errors.New("User not found")
+		}
+
+		active, ok := activeSubscription(*dbStructure, user_id, plan)
+		if ok {
+			subscription = active
+		} else {
+			subscription = Subscription{
+				Id:        nextId(dbStructure.Subscriptions),
+				UserID:    user_id,
+				Plan:      plan,
+				Status:    SubscriptionActive,
+				StartedAt: time.Now().UTC(),
+			}
+		}
+		subscription.CurrentPeriodEnd = current_period_end
+		subscription.CancelAt = time.Time{}
+
+		dbStructure.Subscriptions[subscription.Id] = subscription
+		deriveChirpyRed(*dbStructure)
+		return nil
+	})
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	return subscription, nil
+}
+
+// ScheduleSubscriptionCancel lets the active subscription to plan run
+// until cancel_at and then end. A zero cancel_at means the end of the
+// current period. It does nothing if the user has no active subscription.
+func (db *DB) ScheduleSubscriptionCancel(ctx context.Context, user_id int, plan SubscriptionPlan, cancel_at time.Time) (Subscription, error) {
+	ctx, span := tracer.Start(ctx, "DB.ScheduleSubscriptionCancel")
+	defer span.End()
+
+	subscription := Subscription{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[user_id]; !ok {
+			return errors.New("User not found")
+		}
+
+		active, ok := activeSubscription(*dbStructure, user_id, plan)
+		if !ok {
+			return errNoChanges
+		}
+		subscription = active
+
+		if cancel_at.IsZero() {
+			cancel_at = subscription.CurrentPeriodEnd
+		}
+		if cancel_at.IsZero() {
+			cancel_at = time.Now().UTC()
+		}
+		subscription.CancelAt = cancel_at
+
+		dbStructure.Subscriptions[subscription.Id] = subscription
+		deriveChirpyRed(*dbStructure)
+		return nil
+	})
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	return subscription, nil
+}
+
+// EndSubscription ends the active subscription to plan right away with status.
+// It does nothing if the user has no active subscription.
+func (db *DB) EndSubscription(ctx context.Context, user_id int, plan SubscriptionPlan, status SubscriptionStatus) error {
+	ctx, span := tracer.Start(ctx, "DB.EndSubscription")
+	defer span.End()
+
+	if status == SubscriptionActive {
+		return errors.New("an ended subscription can't be active")
+	}
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[user_id]; !ok {
+			return errors.New("User not found")
+		}
+
+		subscription, ok := activeSubscription(*dbStructure, user_id, plan)
+		if !ok {
+			return errNoChanges
+		}
+
+		subscription.Status = status
+		subscription.EndedAt = time.Now().UTC()
+		dbStructure.Subscriptions[subscription.Id] = subscription
+		deriveChirpyRed(*dbStructure)
+		return nil
+	})
+}
+
+// ExpireSubscriptions ends every active subscription that has lapsed by now
+// and returns how many were ended. Renewals that arrive while it runs
+// are never overwritten.
+func (db *DB) ExpireSubscriptions(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := tracer.Start(ctx, "DB.ExpireSubscriptions")
+	defer span.End()
+
+	expired := 0
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for id, subscription := range dbStructure.Subscriptions {
+			if subscription.Status != SubscriptionActive || !subscription.Lapsed(now) {
+				continue
+			}
+
+			subscription.Status = SubscriptionExpired
+			if !subscription.CancelAt.IsZero() && !now.Before(subscription.CancelAt) {
+				subscription.Status = SubscriptionCanceled
+			}
+			subscription.EndedAt = now.UTC()
+			dbStructure.Subscriptions[id] = subscription
+			expired++
+		}
+		if expired == 0 {
+			return errNoChanges
+		}
+
+		deriveChirpyRed(*dbStructure)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// GetSubscriptionsByUser returns every subscription of a user, newest first
+func (db *DB) GetSubscriptionsByUser(ctx context.Context, user_id int) ([]Subscription, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetSubscriptionsByUser")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]Subscription, 0)
+	for _, subscription := range dbStructure.Subscriptions {
+		if subscription.UserID == user_id {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].Id > subscriptions[j].Id })
+
+	return subscriptions, nil
+}
+
+func activeSubscription(dbStructure DBStructure, user_id int, plan SubscriptionPlan) (Subscription, bool) {
+	for _, subscription := range dbStructure.Subscriptions {
+		if subscription.UserID == user_id && subscription.Plan == plan && subscription.Status == SubscriptionActive {
+			return subscription, true
+		}
+	}
+
+	return Subscription{}, false
+}
+
+// deriveChirpyRed sets User.IsChirpyRed from the users' subscriptions.
+// Lapsed subscriptions stop counting even before they are expired.
+func deriveChirpyRed(dbStructure DBStructure) {
+	now := time.Now()
+
+	is_chirpy_red := make(map[int]bool)
+	for _, subscription := range dbStructure.Subscriptions {
+		if subscription.Plan == PlanChirpyRed && subscription.entitled(now) {
+			is_chirpy_red[subscription.UserID] = true
+		}
+	}
+
+	for id, user := range dbStructure.Users {
+		if user.IsChirpyRed != is_chirpy_red[id] {
+			user.IsChirpyRed = is_chirpy_red[id]
+			dbStructure.Users[id] = user
+		}
+	}
+}
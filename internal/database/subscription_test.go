@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpireSubscriptionsKeepsConcurrentRenewal(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for i := 0; i < 20; i++ {
+		user, err := db.CreateUser(ctx, fmt.Sprintf("user%d@example.com", i), "hash", "")
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		_, err = db.StartSubscription(ctx, user.Id, PlanChirpyRed, time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("StartSubscription: %v", err)
+		}
+
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := db.ExpireSubscriptions(ctx, time.Now())
+			if err != nil {
+				t.Errorf("ExpireSubscriptions: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := db.StartSubscription(ctx, user.Id, PlanChirpyRed, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Errorf("StartSubscription: %v", err)
+			}
+		}()
+		wg.Wait()
+
+		// Whichever ran first, the renewal must not be overwritten
+		user, err = db.GetUserById(ctx, user.Id)
+		if err != nil {
+			t.Fatalf("GetUserById: %v", err)
+		}
+		if !user.IsChirpyRed {
+			t.Fatalf("run %d: renewal was lost to the expiry", i)
+		}
+	}
+}
+
+func TestExpireSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	now := time.Now()
+
+	lapsed, err := db.CreateUser(ctx, "lapsed@example.com", "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	current, err := db.CreateUser(ctx, "current@example.com", "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	_, err = db.StartSubscription(ctx, lapsed.Id, PlanChirpyRed, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+	_, err = db.StartSubscription(ctx, current.Id, PlanChirpyRed, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+
+	expired, err := db.ExpireSubscriptions(ctx, now)
+	if err != nil {
+		t.Fatalf("ExpireSubscriptions: %v", err)
+	}
+	if expired != 1 {
+		t.Fatalf("expired %d subscriptions, want 1", expired)
+	}
+
+	expired, err = db.ExpireSubscriptions(ctx, now)
+	if err != nil {
+		t.Fatalf("ExpireSubscriptions: %v", err)
+	}
+	if expired != 0 {
+		t.Fatalf("expired %d subscriptions on the second run, want 0", expired)
+	}
+
+	subscriptions, err := db.GetSubscriptionsByUser(ctx, lapsed.Id)
+	if err != nil {
+		t.Fatalf("GetSubscriptionsByUser: %v", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].Status != SubscriptionExpired {
+		t.Fatalf("got %+v, want one expired subscription", subscriptions)
+	}
+}
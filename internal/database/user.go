@@ -1,36 +1,111 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"sort"
+	"strings"
+	"time"
 )
 
+// ErrHandleTaken is returned when a handle is already used by another user
+var ErrHandleTaken = errors.New("handle already taken")
+
+// ErrEmailTaken is returned when an email is already used by another user
+var ErrEmailTaken = errors.New("email already taken")
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// Valid reports whether r is one of the known roles
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r grants every permission of required.
+// Users stored before roles existed have an empty role, which ranks as RoleUser.
+func (r Role) AtLeast(required Role) bool {
+	rank, ok := roleRanks[r]
+	if !ok {
+		rank = roleRanks[RoleUser]
+	}
+
+	return rank >= roleRanks[required]
+}
+
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id       int    `json:"id"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// IsChirpyRed is derived from Subscriptions whenever the database is loaded
+	IsChirpyRed   bool      `json:"is_chirpy_red"`
+	EmailVerified bool      `json:"email_verified"`
+	Role          Role      `json:"role"`
+	Handle        string    `json:"handle"`
+	DisplayName   string    `json:"display_name"`
+	Bio           string    `json:"bio"`
+	AvatarURL     string    `json:"avatar_url"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// TOTPSecret is encrypted. It is set but not yet enforced while
+	// TOTPEnabled is false, until the user confirms enrollment.
+	TOTPSecret   string `json:"totp_secret"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"totp_last_step"`
+	// RecoveryCodes holds digests of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// UserProfile holds changes to the profile fields a user can edit.
+// Nil fields keep their current value.
+type UserProfile struct {
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
 }
 
 // CreateUser creates a new user and saves it to disk
-func (db *DB) CreateUser(email, password string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
+func (db *DB) CreateUser(ctx context.Context, email, password, handle string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateUser")
+	defer span.End()
 
-	uniqueId := len(dbStructure.Users) + 1
+	user := User{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if emailTaken(*dbStructure, email, 0) {
+			return ErrEmailTaken
+		}
+		if handleTaken(*dbStructure, handle, 0) {
+			return ErrHandleTaken
+		}
 
-	user := User{
-		Id:          uniqueId,
-		Email:       email,
-		Password:    password,
-		IsChirpyRed: false,
-	}
+		uniqueId := nextId(dbStructure.Users)
 
-	dbStructure.Users[user.Id] = user
+		user = User{
+			Id:          uniqueId,
+			Email:       email,
+			Password:    password,
+			IsChirpyRed: false,
+			Role:        RoleUser,
+			Handle:      handle,
+			CreatedAt:   time.Now().UTC(),
+		}
 
-	err = db.writeDB(dbStructure)
+		dbStructure.Users[user.Id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -39,8 +114,11 @@ func (db *DB) CreateUser(email, password string) (User, error) {
 }
 
 // GetUsers returns all users in the database
-func (db *DB) GetUsers() ([]User, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetUsers(ctx context.Context) ([]User, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUsers")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -56,9 +134,12 @@ func (db *DB) GetUsers() ([]User, error) {
 }
 
 // GetUserById returns user with matching id in the database
-func (db *DB) GetUserById(i int) (User, error) {
+func (db *DB) GetUserById(ctx context.Context, i int) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUserById")
+	defer span.End()
+
 	user := User{}
-	dbStructure, err := db.loadDB()
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return user, err
 	}
@@ -71,25 +152,69 @@ func (db *DB) GetUserById(i int) (User, error) {
 	return user, nil
 }
 
-func (db *DB) UpdateUserCredentials(i int, new_email, new_password string) (User, error) {
-	dbStructure, err := db.loadDB()
+// GetUserByEmail returns user with matching email in the database
+func (db *DB) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUserByEmail")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return User{}, err
 	}
 
-	_, ok := dbStructure.Users[i]
-	if !ok {
-		return User{}, errors.New("User not found")
+	for _, user := range dbStructure.Users {
+		if user.Email == email {
+			return user, nil
+		}
 	}
 
-	new_user := User{
-		Id:       i,
-		Email:    new_email,
-		Password: new_password,
+	return User{}, errors.New("User not found")
+}
+
+// GetUserByHandle returns user with matching handle in the database,
+// ignoring case
+func (db *DB) GetUserByHandle(ctx context.Context, handle string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUserByHandle")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return User{}, err
 	}
-	dbStructure.Users[i] = new_user
 
-	err = db.writeDB(dbStructure)
+	if handle != "" {
+		for _, user := range dbStructure.Users {
+			if strings.EqualFold(user.Handle, handle) {
+				return user, nil
+			}
+		}
+	}
+
+	return User{}, errors.New("User not found")
+}
+
+// UpdateUserEmail changes the email of a user, leaving every other field untouched
+func (db *DB) UpdateUserEmail(ctx context.Context, i int, new_email string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserEmail")
+	defer span.End()
+
+	new_user := User{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[i]
+		if !ok {
+			return errors.New("User not found")
+		}
+
+		if emailTaken(*dbStructure, new_email, i) {
+			return ErrEmailTaken
+		}
+
+		new_user = user
+		new_user.Email = new_email
+		new_user.EmailVerified = false
+		dbStructure.Users[i] = new_user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -97,29 +222,415 @@ func (db *DB) UpdateUserCredentials(i int, new_email, new_password string) (User
 	return new_user, nil
 }
 
-func (db *DB) UpdateUserChirpyRed(i int, is_chirpy_red bool) (User, error) {
-	dbStructure, err := db.loadDB()
+// VerifyUserEmail marks the email of a user as verified,
+// provided it is still the email the verification was sent to
+func (db *DB) VerifyUserEmail(ctx context.Context, i int, email string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.VerifyUserEmail")
+	defer span.End()
+
+	return db.updateUser(ctx, i, func(user *User) error {
+		if user.Email != email {
+			return errors.New("email has changed since verification was requested")
+		}
+		user.EmailVerified = true
+		return nil
+	})
+}
+
+// UpdateUserPassword changes the password hash of a user, leaving every other field untouched
+func (db *DB) UpdateUserPassword(ctx context.Context, i int, new_password string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserPassword")
+	defer span.End()
+
+	return db.updateUser(ctx, i, func(user *User) error {
+		user.Password = new_password
+		return nil
+	})
+}
+
+// ChangeUserPassword changes the password hash of a user and revokes
+// every refresh token they hold in the same write, so no session
+// outlives the old password
+func (db *DB) ChangeUserPassword(ctx context.Context, i int, new_password string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.ChangeUserPassword")
+	defer span.End()
+
+	new_user := User{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[i]
+		if !ok {
+			return errors.New("User not found")
+		}
+
+		user.Password = new_password
+		dbStructure.Users[i] = user
+		revokeUserRefreshTokens(*dbStructure, i)
+		new_user = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	_, ok := dbStructure.Users[i]
-	if !ok {
-		return User{}, errors.New("User not found")
+	return new_user, nil
+}
+
+// UpdateUserProfile changes the profile fields set in profile,
+// leaving every other field untouched
+func (db *DB) UpdateUserProfile(ctx context.Context, i int, profile UserProfile) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserProfile")
+	defer span.End()
+
+	new_user := User{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[i]
+		if !ok {
+			return errors.New("User not found")
+		}
+
+		new_user = user
+		if profile.Handle != nil {
+			if handleTaken(*dbStructure, *profile.Handle, i) {
+				return ErrHandleTaken
+			}
+			new_user.Handle = *profile.Handle
+		}
+		if profile.DisplayName != nil {
+			new_user.DisplayName = *profile.DisplayName
+		}
+		if profile.Bio != nil {
+			new_user.Bio = *profile.Bio
+		}
+		if profile.AvatarURL != nil {
+			new_user.AvatarURL = *profile.AvatarURL
+		}
+		dbStructure.Users[i] = new_user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	new_user := User{
-		Id:          i,
-		Email:       dbStructure.Users[i].Email,
-		Password:    dbStructure.Users[i].Password,
-		IsChirpyRed: is_chirpy_red,
+	return new_user, nil
+}
+
+// UpdateUserRole changes the role of a user
+func (db *DB) UpdateUserRole(ctx context.Context, i int, role Role) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserRole")
+	defer span.End()
+
+	if !role.Valid() {
+		return User{}, errors.New("unknown role")
 	}
-	dbStructure.Users[i] = new_user
 
-	err = db.writeDB(dbStructure)
+	return db.updateUser(ctx, i, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
+
+// SetUserTOTPSecret stores a pending TOTP secret, replacing any earlier enrollment
+func (db *DB) SetUserTOTPSecret(ctx context.Context, i int, encrypted_secret string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.SetUserTOTPSecret")
+	defer span.End()
+
+	return db.updateUser(ctx, i, func(user *User) error {
+		user.TOTPSecret = encrypted_secret
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// EnableUserTOTP turns on two-factor authentication with the pending secret
+func (db *DB) EnableUserTOTP(ctx context.Context, i int, step int64, recovery_code_hashes []string) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.EnableUserTOTP")
+	defer span.End()
+
+	return db.updateUser(ctx, i, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return errors.New("no TOTP enrollment in progress")
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recovery_code_hashes
+		return nil
+	})
+}
+
+// DisableUserTOTP turns off two-factor authentication and forgets the secret
+func (db *DB) DisableUserTOTP(ctx context.Context, i int) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.DisableUserTOTP")
+	defer span.End()
+
+	return db.updateUser(ctx, i, func(user *User) error {
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// UseUserTOTPStep records the time step of an accepted TOTP code,
+// failing if a code from that step or a later one was already used
+func (db *DB) UseUserTOTPStep(ctx context.Context, i int, step int64) error {
+	ctx, span := tracer.Start(ctx, "DB.UseUserTOTPStep")
+	defer span.End()
+
+	_, err := db.updateUser(ctx, i, func(user *User) error {
+		if step <= user.TOTPLastStep {
+			return errors.New("code has already been used")
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+	return err
+}
+
+// ConsumeUserRecoveryCode removes a recovery code digest from a user,
+// failing if the user doesn't have it
+func (db *DB) ConsumeUserRecoveryCode(ctx context.Context, i int, code_hash string) error {
+	ctx, span := tracer.Start(ctx, "DB.ConsumeUserRecoveryCode")
+	defer span.End()
+
+	_, err := db.updateUser(ctx, i, func(user *User) error {
+		for j, recovery_code := range user.RecoveryCodes {
+			if recovery_code == code_hash {
+				user.RecoveryCodes = append(user.RecoveryCodes[:j:j], user.RecoveryCodes[j+1:]...)
+				return nil
+			}
+		}
+		return errors.New("recovery code not found")
+	})
+	return err
+}
+
+// UpdateUserChirpyRed starts an open-ended Chirpy Red subscription for
+// a user or cancels it right away
+func (db *DB) UpdateUserChirpyRed(ctx context.Context, i int, is_chirpy_red bool) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserChirpyRed")
+	defer span.End()
+
+	var err error
+	if is_chirpy_red {
+		_, err = db.StartSubscription(ctx, i, PlanChirpyRed, time.Time{})
+	} else {
+		err = db.EndSubscription(ctx, i, PlanChirpyRed, SubscriptionCanceled)
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return db.GetUserById(ctx, i)
+}
+
+// updateUser loads a user, applies fn and saves the result under one lock
+func (db *DB) updateUser(ctx context.Context, i int, fn func(user *User) error) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.updateUser")
+	defer span.End()
+
+	new_user := User{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[i]
+		if !ok {
+			return errors.New("User not found")
+		}
+
+		err := fn(&user)
+		if err != nil {
+			return err
+		}
+		dbStructure.Users[i] = user
+		new_user = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
 	return new_user, nil
 }
+
+// emailTaken reports whether a user other than exclude_id already uses email
+func emailTaken(dbStructure DBStructure, email string, exclude_id int) bool {
+	for _, user := range dbStructure.Users {
+		if user.Id != exclude_id && user.Email == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleTaken reports whether a user other than exclude_id already uses handle,
+// ignoring case
+func handleTaken(dbStructure DBStructure, handle string, exclude_id int) bool {
+	if handle == "" {
+		return false
+	}
+
+	for _, user := range dbStructure.Users {
+		if user.Id != exclude_id && strings.EqualFold(user.Handle, handle) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UserExport holds everything stored about a user
+type UserExport struct {
+	User          User
+	Chirps        []Chirp
+	RefreshTokens []RefreshToken
+	Identities    []Identity
+	Subscriptions []Subscription
+
+	PersonalAccessTokens []PersonalAccessToken
+	WebhookEndpoints     []WebhookEndpoint
+}
+
+// ExportUser returns the user with matching id together with every row they own
+func (db *DB) ExportUser(ctx context.Context, i int) (UserExport, error) {
+	ctx, span := tracer.Start(ctx, "DB.ExportUser")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	user, ok := dbStructure.Users[i]
+	if !ok {
+		return UserExport{}, errors.New("User not found")
+	}
+
+	export := UserExport{
+		User:          user,
+		Chirps:        make([]Chirp, 0),
+		RefreshTokens: make([]RefreshToken, 0),
+		Identities:    make([]Identity, 0),
+		Subscriptions: make([]Subscription, 0),
+
+		PersonalAccessTokens: make([]PersonalAccessToken, 0),
+		WebhookEndpoints:     make([]WebhookEndpoint, 0),
+	}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == i {
+			export.Chirps = append(export.Chirps, chirp)
+		}
+	}
+	for _, refresh_token := range dbStructure.RefreshTokens {
+		if refresh_token.UserID == i {
+			export.RefreshTokens = append(export.RefreshTokens, refresh_token)
+		}
+	}
+	for _, identity := range dbStructure.Identities {
+		if identity.UserID == i {
+			export.Identities = append(export.Identities, identity)
+		}
+	}
+	for _, subscription := range dbStructure.Subscriptions {
+		if subscription.UserID == i {
+			export.Subscriptions = append(export.Subscriptions, subscription)
+		}
+	}
+	for _, personal_access_token := range dbStructure.PersonalAccessTokens {
+		if personal_access_token.UserID == i {
+			export.PersonalAccessTokens = append(export.PersonalAccessTokens, personal_access_token)
+		}
+	}
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		if endpoint.UserID == i {
+			export.WebhookEndpoints = append(export.WebhookEndpoints, endpoint)
+		}
+	}
+
+	sort.Slice(export.Chirps, func(i, j int) bool { return export.Chirps[i].Id < export.Chirps[j].Id })
+	sort.Slice(export.RefreshTokens, func(i, j int) bool { return export.RefreshTokens[i].Id < export.RefreshTokens[j].Id })
+	sort.Slice(export.PersonalAccessTokens, func(i, j int) bool {
+		return export.PersonalAccessTokens[i].Id < export.PersonalAccessTokens[j].Id
+	})
+	sort.Slice(export.WebhookEndpoints, func(i, j int) bool { return export.WebhookEndpoints[i].Id < export.WebhookEndpoints[j].Id })
+
+	return export, nil
+}
+
+// DeleteUser deletes a user along with every row about them in a single
+// write: chirps, sessions, email tokens, identities, personal access tokens,
+// subscriptions, webhooks, received billing events and failed logins
+func (db *DB) DeleteUser(ctx context.Context, i int) error {
+	ctx, span := tracer.Start(ctx, "DB.DeleteUser")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[i]
+		if !ok {
+			return errors.New("User not found")
+		}
+
+		delete(dbStructure.Users, i)
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.AuthorId == i {
+				delete(dbStructure.Chirps, id)
+				delete(dbStructure.ScheduledChirps, id)
+			}
+		}
+		delete(dbStructure.ChirpCreations, i)
+		revokeUserRefreshTokens(*dbStructure, i)
+		for id, user_token := range dbStructure.UserTokens {
+			if user_token.UserID == i {
+				delete(dbStructure.UserTokens, id)
+			}
+		}
+
+		// Login states don't know who is signing in, so every login in
+		// progress at a provider the user was linked to is cancelled,
+		// lest it link the deleted user's identity to a new account
+		providers := make(map[string]bool)
+		for id, identity := range dbStructure.Identities {
+			if identity.UserID == i {
+				providers[identity.Provider] = true
+				delete(dbStructure.Identities, id)
+			}
+		}
+		for id, login_state := range dbStructure.OIDCLoginStates {
+			if providers[login_state.Provider] {
+				delete(dbStructure.OIDCLoginStates, id)
+			}
+		}
+
+		for id, personal_access_token := range dbStructure.PersonalAccessTokens {
+			if personal_access_token.UserID == i {
+				deletePersonalAccessToken(*dbStructure, id)
+			}
+		}
+		for id, subscription := range dbStructure.Subscriptions {
+			if subscription.UserID == i {
+				delete(dbStructure.Subscriptions, id)
+			}
+		}
+		for id, endpoint := range dbStructure.WebhookEndpoints {
+			if endpoint.UserID == i {
+				deleteWebhookEndpoint(*dbStructure, id)
+			}
+		}
+		for id, event := range dbStructure.WebhookEvents {
+			if event.UserID == i {
+				delete(dbStructure.WebhookEvents, id)
+			}
+		}
+
+		// Failed logins are kept by email too, for attempts on unknown
+		// or mistyped accounts
+		for id, attempt := range dbStructure.FailedLogins {
+			if attempt.UserID == i || strings.EqualFold(attempt.Email, user.Email) {
+				delete(dbStructure.FailedLogins, id)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seedUser creates a user with a row in every table that refers to users
+func seedUser(t *testing.T, db *DB, email, provider string) User {
+	t.Helper()
+	ctx := context.Background()
+	expires_at := time.Now().Add(time.Hour)
+
+	user, err := db.CreateUser(ctx, email, "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	steps := []func() error{
+		func() error { _, err := db.CreateChirp(ctx, user.Id, "hello", nil, 100); return err },
+		func() error {
+			_, err := db.CreateRefreshToken(ctx, user.Id, email+"-refresh", expires_at, "", "")
+			return err
+		},
+		func() error {
+			_, err := db.CreateUserToken(ctx, user.Id, UserTokenPasswordReset, email, email+"-reset", expires_at)
+			return err
+		},
+		func() error { _, err := db.CreateIdentity(ctx, user.Id, provider, email+"-subject", email); return err },
+		func() error {
+			_, err := db.CreateOIDCLoginState(ctx, provider, email+"-state", "nonce", "verifier", expires_at)
+			return err
+		},
+		func() error {
+			_, err := db.CreatePersonalAccessToken(ctx, user.Id, "ci", "hint", email+"-pat", nil, time.Time{}, 50)
+			return err
+		},
+		func() error { _, err := db.StartSubscription(ctx, user.Id, PlanChirpyRed, time.Time{}); return err },
+		func() error {
+			_, err := db.CreateWebhookEndpoint(ctx, user.Id, "https://example.com/hook", "secret", []string{"chirp.created"})
+			return err
+		},
+		func() error {
+			_, err := db.CreateWebhookEvent(ctx, "polka", email+"-event", "user.upgraded", user.Id)
+			return err
+		},
+		func() error {
+			// An attempt on the account before it was looked up has no user id
+			return db.RecordFailedLogin(ctx, FailedLogin{Email: email, Reason: "bad password", At: time.Now()})
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("seeding %s: %v", email, err)
+		}
+	}
+
+	return user
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	deleted := seedUser(t, db, "deleted@example.com", "google")
+	kept := seedUser(t, db, "kept@example.com", "github")
+
+	err := db.DeleteUser(ctx, deleted.Id)
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == deleted.Id {
+			counts["chirps"]++
+		}
+	}
+	for _, refresh_token := range dbStructure.RefreshTokens {
+		if refresh_token.UserID == deleted.Id {
+			counts["refresh tokens"]++
+		}
+	}
+	for _, user_token := range dbStructure.UserTokens {
+		if user_token.UserID == deleted.Id {
+			counts["user tokens"]++
+		}
+	}
+	for _, identity := range dbStructure.Identities {
+		if identity.UserID == deleted.Id {
+			counts["identities"]++
+		}
+	}
+	for _, login_state := range dbStructure.OIDCLoginStates {
+		if login_state.Provider == "google" {
+			counts["oidc login states"]++
+		}
+	}
+	for _, personal_access_token := range dbStructure.PersonalAccessTokens {
+		if personal_access_token.UserID == deleted.Id {
+			counts["personal access tokens"]++
+		}
+	}
+	for _, subscription := range dbStructure.Subscriptions {
+		if subscription.UserID == deleted.Id {
+			counts["subscriptions"]++
+		}
+	}
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		if endpoint.UserID == deleted.Id {
+			counts["webhook endpoints"]++
+		}
+	}
+	for _, event := range dbStructure.WebhookEvents {
+		if event.UserID == deleted.Id {
+			counts["webhook events"]++
+		}
+	}
+	for _, attempt := range dbStructure.FailedLogins {
+		if attempt.Email == deleted.Email {
+			counts["failed logins"]++
+		}
+	}
+	for table, count := range counts {
+		t.Errorf("%d %s of the deleted user survived", count, table)
+	}
+
+	export, err := db.ExportUser(ctx, kept.Id)
+	if err != nil {
+		t.Fatalf("ExportUser of the other user: %v", err)
+	}
+	if len(export.Chirps) != 1 || len(export.Identities) != 1 || len(export.PersonalAccessTokens) != 1 || len(export.WebhookEndpoints) != 1 {
+		t.Errorf("rows of the other user were deleted: %+v", export)
+	}
+	if len(dbStructure.OIDCLoginStates) != 1 || len(dbStructure.FailedLogins) != 1 || len(dbStructure.WebhookEvents) != 1 {
+		t.Errorf("unowned rows of the other user were deleted")
+	}
+}
+
+func TestDeleteUserUnknown(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.DeleteUser(context.Background(), 42)
+	if err == nil {
+		t.Fatal("deleting an unknown user succeeded")
+	}
+}
+
+func TestCreateUserConcurrentDuplicates(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	const attempts = 20
+	errs := make([]error, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.CreateUser(ctx, "user@example.com", "hash", "")
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrEmailTaken):
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d users created with the same email, want exactly 1", created)
+	}
+}
+
+func TestUpdateUserProfileConcurrentFields(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	user, err := db.CreateUser(ctx, "user@example.com", "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	bio := "hello"
+	display_name := "User"
+	wg := sync.WaitGroup{}
+	for _, profile := range []UserProfile{{Bio: &bio}, {DisplayName: &display_name}} {
+		wg.Add(1)
+		go func(profile UserProfile) {
+			defer wg.Done()
+			_, err := db.UpdateUserProfile(ctx, user.Id, profile)
+			if err != nil {
+				t.Errorf("UpdateUserProfile: %v", err)
+			}
+		}(profile)
+	}
+	wg.Wait()
+
+	user, err = db.GetUserById(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if user.Bio != bio || user.DisplayName != display_name {
+		t.Fatalf("profile = %q/%q, want both updates %q/%q", user.Bio, user.DisplayName, bio, display_name)
+	}
+}
+
+func TestChangeUserPasswordRevokesSessions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	expires_at := time.Now().Add(time.Hour)
+
+	user, err := db.CreateUser(ctx, "user@example.com", "old", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	other, err := db.CreateUser(ctx, "other@example.com", "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	for _, refresh_token := range []struct {
+		user_id int
+		hash    string
+	}{{user.Id, "a"}, {user.Id, "b"}, {other.Id, "c"}} {
+		_, err = db.CreateRefreshToken(ctx, refresh_token.user_id, refresh_token.hash, expires_at, "", "")
+		if err != nil {
+			t.Fatalf("CreateRefreshToken: %v", err)
+		}
+	}
+
+	user, err = db.ChangeUserPassword(ctx, user.Id, "new")
+	if err != nil {
+		t.Fatalf("ChangeUserPassword: %v", err)
+	}
+	if user.Password != "new" {
+		t.Fatalf("password = %q, want %q", user.Password, "new")
+	}
+
+	refresh_tokens, err := db.GetRefreshTokens(ctx)
+	if err != nil {
+		t.Fatalf("GetRefreshTokens: %v", err)
+	}
+	if len(refresh_tokens) != 1 || refresh_tokens[0].UserID != other.Id {
+		t.Fatalf("refresh tokens left = %+v, want only the other user's", refresh_tokens)
+	}
+}
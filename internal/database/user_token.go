@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type UserTokenPurpose string
+
+const (
+	UserTokenEmailVerification UserTokenPurpose = "email_verification"
+	UserTokenPasswordReset     UserTokenPurpose = "password_reset"
+)
+
+// UserToken is a single-use token sent to a user by email.
+// Only a digest of the token is stored.
+type UserToken struct {
+	Id        int              `json:"id"`
+	UserID    int              `json:"user_id"`
+	Purpose   UserTokenPurpose `json:"purpose"`
+	Email     string           `json:"email"`
+	TokenHash string           `json:"token_hash"`
+	CreatedAt time.Time        `json:"created_at"`
+	ExpiresAt time.Time        `json:"expires_at"`
+}
+
+// CreateUserToken creates a new user token and saves it to disk.
+// Earlier tokens of the same purpose for the user stop working.
+func (db *DB) CreateUserToken(ctx context.Context, user_id int, purpose UserTokenPurpose, email, token_hash string, expires_at time.Time) (UserToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateUserToken")
+	defer span.End()
+
+	user_token := UserToken{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		uniqueId := nextId(dbStructure.UserTokens)
+		for id, user_token := range dbStructure.UserTokens {
+			if user_token.UserID == user_id && user_token.Purpose == purpose {
+				delete(dbStructure.UserTokens, id)
+			}
+		}
+
+		user_token = UserToken{
+			Id:        uniqueId,
+			UserID:    user_id,
+			Purpose:   purpose,
+			Email:     email,
+			TokenHash: token_hash,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expires_at,
+		}
+
+		dbStructure.UserTokens[user_token.Id] = user_token
+		return nil
+	})
+	if err != nil {
+		return UserToken{}, err
+	}
+
+	return user_token, nil
+}
+
+// ConsumeUserToken looks up a user token by digest and deletes it,
+// so that every token can only be used once. The lookup and the delete
+// happen under one lock, so concurrent requests can't both consume it.
+func (db *DB) ConsumeUserToken(ctx context.Context, purpose UserTokenPurpose, token_hash string) (UserToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.ConsumeUserToken")
+	defer span.End()
+
+	user_token := UserToken{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for id, candidate := range dbStructure.UserTokens {
+			if candidate.Purpose != purpose || candidate.TokenHash != token_hash {
+				continue
+			}
+
+			// Expired tokens are deleted too
+			delete(dbStructure.UserTokens, id)
+			user_token = candidate
+			return nil
+		}
+
+		return errors.New("token not found")
+	})
+	if err != nil {
+		return UserToken{}, err
+	}
+
+	if user_token.ExpiresAt.Before(time.Now().UTC()) {
+		return UserToken{}, errors.New("token has expired")
+	}
+
+	return user_token, nil
+}
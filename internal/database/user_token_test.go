@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsumeUserTokenConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	_, err := db.CreateUserToken(ctx, 1, UserTokenPasswordReset, "user@example.com", "digest", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateUserToken: %v", err)
+	}
+
+	const attempts = 20
+	errs := make([]error, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.ConsumeUserToken(ctx, UserTokenPasswordReset, "digest")
+		}(i)
+	}
+	wg.Wait()
+
+	consumed := 0
+	for _, err := range errs {
+		if err == nil {
+			consumed++
+		}
+	}
+	if consumed != 1 {
+		t.Fatalf("token was consumed %d times, want exactly 1", consumed)
+	}
+}
+
+func TestConsumeUserTokenExpired(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	_, err := db.CreateUserToken(ctx, 1, UserTokenEmailVerification, "user@example.com", "digest", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("CreateUserToken: %v", err)
+	}
+
+	_, err = db.ConsumeUserToken(ctx, UserTokenEmailVerification, "digest")
+	if err == nil || err.Error() != "token has expired" {
+		t.Fatalf("got %v, want token has expired", err)
+	}
+
+	// The expired token is gone rather than left to be tried again
+	_, err = db.ConsumeUserToken(ctx, UserTokenEmailVerification, "digest")
+	if err == nil || err.Error() != "token not found" {
+		t.Fatalf("got %v, want token not found", err)
+	}
+}
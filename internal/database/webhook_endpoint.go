@@ -0,0 +1,343 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// WebhookEndpoint is a URL a user wants events sent to.
+// Endpoints of admins receive events about every user.
+type WebhookEndpoint struct {
+	Id        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	// WebhookDeliveryDead deliveries ran out of attempts
+	WebhookDeliveryDead WebhookDeliveryStatus = "dead"
+)
+
+const (
+	// webhookDeliveryRetention is how long finished deliveries are kept
+	// for endpoint owners to inspect and retry
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+	// maxFinishedWebhookDeliveries caps finished deliveries across all endpoints
+	maxFinishedWebhookDeliveries = 10000
+)
+
+// finished reports whether the delivery is no longer queued
+func (d WebhookDelivery) finished() bool {
+	return d.Status == WebhookDeliveryDelivered || d.Status == WebhookDeliveryDead
+}
+
+// WebhookDelivery is one event queued for one endpoint
+type WebhookDelivery struct {
+	Id             int                   `json:"id"`
+	EndpointID     int                   `json:"endpoint_id"`
+	Event          string                `json:"event"`
+	Payload        string                `json:"payload"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts"`
+	NextAttemptAt  time.Time             `json:"next_attempt_at"`
+	LastAttemptAt  time.Time             `json:"last_attempt_at"`
+	LastStatusCode int                   `json:"last_status_code"`
+	LastError      string                `json:"last_error"`
+	CreatedAt      time.Time             `json:"created_at"`
+}
+
+// WebhookAttempt is the outcome of sending a delivery once
+type WebhookAttempt struct {
+	At         time.Time
+	StatusCode int
+	Error      string
+	Delivered  bool
+	// NextAttemptAt is when to try again; zero dead-letters the delivery
+	NextAttemptAt time.Time
+}
+
+// subscribed reports whether the endpoint wants event
+func (e WebhookEndpoint) subscribed(event string) bool {
+	for _, subscribed := range e.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateWebhookEndpoint registers a webhook endpoint and saves it to disk
+func (db *DB) CreateWebhookEndpoint(ctx context.Context, user_id int, url, secret string, events []string) (WebhookEndpoint, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateWebhookEndpoint")
+	defer span.End()
+
+	endpoint := WebhookEndpoint{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[user_id]; !ok {
+			return errors.New("User not found")
+		}
+
+		endpoint = WebhookEndpoint{
+			Id:        nextId(dbStructure.WebhookEndpoints),
+			UserID:    user_id,
+			URL:       url,
+			Secret:    secret,
+			Events:    events,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		dbStructure.WebhookEndpoints[endpoint.Id] = endpoint
+		return nil
+	})
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+// GetWebhookEndpointsByUser returns the webhook endpoints of a user
+func (db *DB) GetWebhookEndpointsByUser(ctx context.Context, user_id int) ([]WebhookEndpoint, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetWebhookEndpointsByUser")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]WebhookEndpoint, 0)
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		if endpoint.UserID == user_id {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Id < endpoints[j].Id })
+
+	return endpoints, nil
+}
+
+// GetWebhookEndpoint returns the webhook endpoint with matching id
+func (db *DB) GetWebhookEndpoint(ctx context.Context, i int) (WebhookEndpoint, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetWebhookEndpoint")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	endpoint, ok := dbStructure.WebhookEndpoints[i]
+	if !ok {
+		return WebhookEndpoint{}, errors.New("webhook endpoint not found")
+	}
+
+	return endpoint, nil
+}
+
+// DeleteWebhookEndpoint deletes a webhook endpoint along with its deliveries
+func (db *DB) DeleteWebhookEndpoint(ctx context.Context, i int) error {
+	ctx, span := tracer.Start(ctx, "DB.DeleteWebhookEndpoint")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.WebhookEndpoints[i]; !ok {
+			return errors.New("webhook endpoint not found")
+		}
+
+		deleteWebhookEndpoint(*dbStructure, i)
+		return nil
+	})
+}
+
+// EnqueueWebhookEvent queues payload for every endpoint subscribed to event
+// that may see events about user_id, and returns how many were queued
+func (db *DB) EnqueueWebhookEvent(ctx context.Context, event string, user_id int, payload string) (int, error) {
+	ctx, span := tracer.Start(ctx, "DB.EnqueueWebhookEvent")
+	defer span.End()
+
+	queued := 0
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		pruneWebhookDeliveries(*dbStructure, now)
+
+		id := nextId(dbStructure.WebhookDeliveries)
+		for _, endpoint := range dbStructure.WebhookEndpoints {
+			if !endpoint.subscribed(event) {
+				continue
+			}
+			if endpoint.UserID != user_id && dbStructure.Users[endpoint.UserID].Role != RoleAdmin {
+				continue
+			}
+
+			delivery := WebhookDelivery{
+				Id:            id,
+				EndpointID:    endpoint.Id,
+				Event:         event,
+				Payload:       payload,
+				Status:        WebhookDeliveryPending,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			}
+			dbStructure.WebhookDeliveries[delivery.Id] = delivery
+			id++
+			queued++
+		}
+		if queued == 0 {
+			return errNoChanges
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return queued, nil
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose
+// next attempt is due by now, oldest first
+func (db *DB) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetDueWebhookDeliveries")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0)
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.Status == WebhookDeliveryPending && !delivery.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Id < deliveries[j].Id })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt saves the outcome of sending a delivery
+func (db *DB) RecordWebhookAttempt(ctx context.Context, i int, attempt WebhookAttempt) (WebhookDelivery, error) {
+	ctx, span := tracer.Start(ctx, "DB.RecordWebhookAttempt")
+	defer span.End()
+
+	delivery := WebhookDelivery{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		stored, ok := dbStructure.WebhookDeliveries[i]
+		if !ok {
+			return errors.New("webhook delivery not found")
+		}
+
+		delivery = stored
+		delivery.Attempts++
+		delivery.LastAttemptAt = attempt.At
+		delivery.LastStatusCode = attempt.StatusCode
+		delivery.LastError = attempt.Error
+		switch {
+		case attempt.Delivered:
+			delivery.Status = WebhookDeliveryDelivered
+		case attempt.NextAttemptAt.IsZero():
+			delivery.Status = WebhookDeliveryDead
+		default:
+			delivery.NextAttemptAt = attempt.NextAttemptAt
+		}
+		dbStructure.WebhookDeliveries[i] = delivery
+		pruneWebhookDeliveries(*dbStructure, attempt.At)
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// RetryWebhookDelivery puts a dead-lettered delivery back in the queue
+func (db *DB) RetryWebhookDelivery(ctx context.Context, endpoint_id, i int) (WebhookDelivery, error) {
+	ctx, span := tracer.Start(ctx, "DB.RetryWebhookDelivery")
+	defer span.End()
+
+	delivery := WebhookDelivery{}
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		stored, ok := dbStructure.WebhookDeliveries[i]
+		if !ok || stored.EndpointID != endpoint_id {
+			return errors.New("webhook delivery not found")
+		}
+		if stored.Status != WebhookDeliveryDead {
+			return errors.New("only dead deliveries can be retried")
+		}
+
+		delivery = stored
+		delivery.Status = WebhookDeliveryPending
+		delivery.Attempts = 0
+		delivery.NextAttemptAt = time.Now().UTC()
+		dbStructure.WebhookDeliveries[i] = delivery
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// GetWebhookDeliveriesByEndpoint returns the most recent deliveries to an endpoint, newest first
+func (db *DB) GetWebhookDeliveriesByEndpoint(ctx context.Context, endpoint_id, limit int) ([]WebhookDelivery, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetWebhookDeliveriesByEndpoint")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0)
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.EndpointID == endpoint_id {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Id > deliveries[j].Id })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// pruneWebhookDeliveries deletes finished deliveries whose last attempt is
+// older than webhookDeliveryRetention, then the oldest finished deliveries
+// past maxFinishedWebhookDeliveries. Pending deliveries are always kept.
+func pruneWebhookDeliveries(dbStructure DBStructure, now time.Time) {
+	for id, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.finished() && delivery.LastAttemptAt.Before(now.Add(-webhookDeliveryRetention)) {
+			delete(dbStructure.WebhookDeliveries, id)
+		}
+	}
+	pruneOldestWhere(dbStructure.WebhookDeliveries, maxFinishedWebhookDeliveries, WebhookDelivery.finished)
+}
+
+func deleteWebhookEndpoint(dbStructure DBStructure, i int) {
+	delete(dbStructure.WebhookEndpoints, i)
+	for id, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.EndpointID == i {
+			delete(dbStructure.WebhookDeliveries, id)
+		}
+	}
+}
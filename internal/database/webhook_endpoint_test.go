@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEnqueueWebhookEventGivesEachDeliveryAnId(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	user, err := db.CreateUser(ctx, "user@example.com", "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = db.CreateWebhookEndpoint(ctx, user.Id, "https://example.com/hook", "secret", []string{"chirp.created"})
+		if err != nil {
+			t.Fatalf("CreateWebhookEndpoint: %v", err)
+		}
+	}
+
+	queued, err := db.EnqueueWebhookEvent(ctx, "chirp.created", user.Id, "{}")
+	if err != nil {
+		t.Fatalf("EnqueueWebhookEvent: %v", err)
+	}
+	deliveries, err := db.GetDueWebhookDeliveries(ctx, time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatalf("GetDueWebhookDeliveries: %v", err)
+	}
+	if queued != 3 || len(deliveries) != 3 {
+		t.Fatalf("queued %d and stored %d deliveries, want 3", queued, len(deliveries))
+	}
+	for i, delivery := range deliveries {
+		if delivery.Id != i+1 {
+			t.Errorf("delivery %d has id %d, want %d", i, delivery.Id, i+1)
+		}
+	}
+}
+
+func TestRecordWebhookAttemptPrunesFinished(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	now := time.Now().UTC()
+	old := now.Add(-webhookDeliveryRetention - time.Hour)
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for id, delivery := range map[int]WebhookDelivery{
+			1: {Status: WebhookDeliveryDelivered, LastAttemptAt: old},
+			2: {Status: WebhookDeliveryDead, LastAttemptAt: old},
+			3: {Status: WebhookDeliveryPending, LastAttemptAt: old},
+			4: {Status: WebhookDeliveryDelivered, LastAttemptAt: now},
+		} {
+			delivery.Id = id
+			dbStructure.WebhookDeliveries[id] = delivery
+		}
+		// Finished deliveries past the cap, all recent
+		for id := 5; id < 5+maxFinishedWebhookDeliveries; id++ {
+			dbStructure.WebhookDeliveries[id] = WebhookDelivery{Id: id, Status: WebhookDeliveryDelivered, LastAttemptAt: now}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	_, err = db.RecordWebhookAttempt(ctx, 3, WebhookAttempt{At: now, StatusCode: 500, NextAttemptAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("RecordWebhookAttempt: %v", err)
+	}
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+	for id, want := range map[int]bool{1: false, 2: false, 3: true, 4: false, 5: true} {
+		if _, ok := dbStructure.WebhookDeliveries[id]; ok != want {
+			t.Errorf("delivery %d kept = %v, want %v", id, ok, want)
+		}
+	}
+	if len(dbStructure.WebhookDeliveries) != maxFinishedWebhookDeliveries+1 {
+		t.Errorf("%d deliveries kept, want %d", len(dbStructure.WebhookDeliveries), maxFinishedWebhookDeliveries+1)
+	}
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrWebhookEventDuplicate is returned when an event has already been received
+var ErrWebhookEventDuplicate = errors.New("webhook event already received")
+
+type WebhookEventStatus string
+
+const (
+	WebhookEventProcessing WebhookEventStatus = "processing"
+	WebhookEventProcessed  WebhookEventStatus = "processed"
+	WebhookEventIgnored    WebhookEventStatus = "ignored"
+	WebhookEventFailed     WebhookEventStatus = "failed"
+)
+
+// WebhookEvent is a webhook received from a third party
+type WebhookEvent struct {
+	Id         int                `json:"id"`
+	Source     string             `json:"source"`
+	EventId    string             `json:"event_id"`
+	Event      string             `json:"event"`
+	UserID     int                `json:"user_id"`
+	Status     WebhookEventStatus `json:"status"`
+	Error      string             `json:"error"`
+	ReceivedAt time.Time          `json:"received_at"`
+}
+
+const (
+	// webhookEventStaleAfter is how long an event may stay processing before
+	// it is assumed that the server stopped while handling it
+	webhookEventStaleAfter = 5 * time.Minute
+
+	// webhookEventRetention is how long handled events are kept to catch
+	// duplicates; senders give up retrying long before
+	webhookEventRetention = 30 * 24 * time.Hour
+	// maxHandledWebhookEvents caps handled events across all sources
+	maxHandledWebhookEvents = 10000
+)
+
+// handled reports whether the event was processed or ignored,
+// so it only matters for catching duplicates
+func (e WebhookEvent) handled() bool {
+	return e.Status == WebhookEventProcessed || e.Status == WebhookEventIgnored
+}
+
+// CreateWebhookEvent saves a received event as processing.
+// An event with the same source and event id that didn't fail is a
+// duplicate, unless it has been processing for so long that handling it
+// was cut short. Every event needs an event id to be told apart.
+func (db *DB) CreateWebhookEvent(ctx context.Context, source, event_id, event string, user_id int) (WebhookEvent, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateWebhookEvent")
+	defer span.End()
+
+	webhook_event := WebhookEvent{}
+	if event_id == "" {
+		return WebhookEvent{}, errors.New("event id is required")
+	}
+
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		pruneWebhookEvents(*dbStructure, now)
+
+		for id, received := range dbStructure.WebhookEvents {
+			if received.Source != source || received.EventId != event_id {
+				continue
+			}
+			stale := received.Status == WebhookEventProcessing && received.ReceivedAt.Before(now.Add(-webhookEventStaleAfter))
+			if received.Status != WebhookEventFailed && !stale {
+				webhook_event = received
+				return ErrWebhookEventDuplicate
+			}
+			// Failed events are retried, and only the last attempt is kept
+			delete(dbStructure.WebhookEvents, id)
+		}
+
+		webhook_event = WebhookEvent{
+			Id:         nextId(dbStructure.WebhookEvents),
+			Source:     source,
+			EventId:    event_id,
+			Event:      event,
+			UserID:     user_id,
+			Status:     WebhookEventProcessing,
+			ReceivedAt: now,
+		}
+
+		dbStructure.WebhookEvents[webhook_event.Id] = webhook_event
+		return nil
+	})
+	if errors.Is(err, ErrWebhookEventDuplicate) {
+		return webhook_event, err
+	}
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return webhook_event, nil
+}
+
+// UpdateWebhookEventStatus records how handling an event ended
+func (db *DB) UpdateWebhookEventStatus(ctx context.Context, i int, status WebhookEventStatus, error_message string) error {
+	ctx, span := tracer.Start(ctx, "DB.UpdateWebhookEventStatus")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		webhook_event, ok := dbStructure.WebhookEvents[i]
+		if !ok {
+			return errors.New("webhook event not found")
+		}
+
+		webhook_event.Status = status
+		webhook_event.Error = error_message
+		dbStructure.WebhookEvents[i] = webhook_event
+		return nil
+	})
+}
+
+// pruneWebhookEvents deletes handled events received longer than
+// webhookEventRetention ago, then the oldest handled events past
+// maxHandledWebhookEvents. Events still processing or failed are kept.
+func pruneWebhookEvents(dbStructure DBStructure, now time.Time) {
+	for id, webhook_event := range dbStructure.WebhookEvents {
+		if webhook_event.handled() && webhook_event.ReceivedAt.Before(now.Add(-webhookEventRetention)) {
+			delete(dbStructure.WebhookEvents, id)
+		}
+	}
+	pruneOldestWhere(dbStructure.WebhookEvents, maxHandledWebhookEvents, WebhookEvent.handled)
+}
+
+// GetWebhookEvents returns the most recent events from source, newest first
+func (db *DB) GetWebhookEvents(ctx context.Context, source string, limit int) ([]WebhookEvent, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetWebhookEvents")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook_events := make([]WebhookEvent, 0)
+	for _, webhook_event := range dbStructure.WebhookEvents {
+		if webhook_event.Source == source {
+			webhook_events = append(webhook_events, webhook_event)
+		}
+	}
+
+	sort.Slice(webhook_events, func(i, j int) bool { return webhook_events[i].Id > webhook_events[j].Id })
+	if len(webhook_events) > limit {
+		webhook_events = webhook_events[:limit]
+	}
+
+	return webhook_events, nil
+}
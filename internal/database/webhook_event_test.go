@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateWebhookEventDeduplicates(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		status    WebhookEventStatus
+		age       time.Duration
+		duplicate bool
+	}{
+		{"processed", WebhookEventProcessed, 0, true},
+		{"ignored", WebhookEventIgnored, 0, true},
+		{"processing", WebhookEventProcessing, time.Minute, true},
+		{"failed", WebhookEventFailed, 0, false},
+		{"stale processing", WebhookEventProcessing, webhookEventStaleAfter + time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+
+			first, err := db.CreateWebhookEvent(ctx, "polka", "evt_1", "user.upgraded", 1)
+			if err != nil {
+				t.Fatalf("CreateWebhookEvent: %v", err)
+			}
+			err = db.update(ctx, func(dbStructure *DBStructure) error {
+				webhook_event := dbStructure.WebhookEvents[first.Id]
+				webhook_event.Status = tt.status
+				webhook_event.ReceivedAt = webhook_event.ReceivedAt.Add(-tt.age)
+				dbStructure.WebhookEvents[first.Id] = webhook_event
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+
+			_, err = db.CreateWebhookEvent(ctx, "polka", "evt_1", "user.upgraded", 1)
+			if tt.duplicate && !errors.Is(err, ErrWebhookEventDuplicate) {
+				t.Fatalf("got %v, want ErrWebhookEventDuplicate", err)
+			}
+			if !tt.duplicate && err != nil {
+				t.Fatalf("retry was rejected: %v", err)
+			}
+
+			webhook_events, err := db.GetWebhookEvents(ctx, "polka", 10)
+			if err != nil {
+				t.Fatalf("GetWebhookEvents: %v", err)
+			}
+			if len(webhook_events) != 1 {
+				t.Fatalf("%d events kept, want 1", len(webhook_events))
+			}
+		})
+	}
+}
+
+func TestCreateWebhookEventConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	const attempts = 20
+	errs := make([]error, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.CreateWebhookEvent(ctx, "polka", "evt_1", "user.upgraded", 1)
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrWebhookEventDuplicate):
+			t.Errorf("attempt %d: unexpected error %v", i, err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("event was handled %d times, want exactly 1", created)
+	}
+}
+
+func TestCreateWebhookEventPrunesHandled(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	now := time.Now().UTC()
+	old := now.Add(-webhookEventRetention - time.Hour)
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for id, webhook_event := range map[int]WebhookEvent{
+			1: {Status: WebhookEventProcessed, ReceivedAt: old},
+			2: {Status: WebhookEventIgnored, ReceivedAt: old},
+			3: {Status: WebhookEventFailed, ReceivedAt: old},
+			4: {Status: WebhookEventProcessed, ReceivedAt: now},
+		} {
+			webhook_event.Id = id
+			webhook_event.Source = "polka"
+			dbStructure.WebhookEvents[id] = webhook_event
+		}
+		// Handled events past the cap, all recent
+		for id := 5; id < 5+maxHandledWebhookEvents; id++ {
+			dbStructure.WebhookEvents[id] = WebhookEvent{Id: id, Source: "polka", Status: WebhookEventProcessed, ReceivedAt: now}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	_, err = db.CreateWebhookEvent(ctx, "polka", "evt_new", "user.upgraded", 1)
+	if err != nil {
+		t.Fatalf("CreateWebhookEvent: %v", err)
+	}
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+	for id, want := range map[int]bool{1: false, 2: false, 3: true, 4: false, 5: true} {
+		if _, ok := dbStructure.WebhookEvents[id]; ok != want {
+			t.Errorf("event %d kept = %v, want %v", id, ok, want)
+		}
+	}
+	// The handled events left fill the cap, next to the failed and new ones
+	if len(dbStructure.WebhookEvents) != maxHandledWebhookEvents+2 {
+		t.Errorf("%d events kept, want %d", len(dbStructure.WebhookEvents), maxHandledWebhookEvents+2)
+	}
+}
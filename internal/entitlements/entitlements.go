@@ -0,0 +1,88 @@
+// Package entitlements decides what a user's plan lets them do.
+// Handlers ask for a user's Entitlements instead of checking
+// User.IsChirpyRed themselves, so plans can change in one place.
+package entitlements
+
+import (
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+// Feature is something only some plans include
+type Feature string
+
+const (
+	FeatureLongChirps      Feature = "long_chirps"
+	FeatureChirpEditing    Feature = "chirp_editing"
+	FeatureScheduledChirps Feature = "scheduled_chirps"
+)
+
+type Tier string
+
+const (
+	TierFree      Tier = "free"
+	TierChirpyRed Tier = "chirpy_red"
+)
+
+// Limits are the quotas of a plan
+type Limits struct {
+	// MaxChirpLength is in characters
+	MaxChirpLength int
+	// ChirpsPerHour is how many chirps may be posted in any hour
+	ChirpsPerHour int
+	// MaxScheduleAhead is how far ahead a chirp may be scheduled
+	MaxScheduleAhead time.Duration
+}
+
+// Entitlements are the features and limits of one user
+type Entitlements struct {
+	Tier     Tier
+	Features map[Feature]bool
+	Limits   Limits
+}
+
+// FreeChirpLength is how long a chirp can be on the free plan
+const FreeChirpLength = 140
+
+var plans = map[Tier]Entitlements{
+	TierFree: {
+		Tier:     TierFree,
+		Features: map[Feature]bool{},
+		Limits: Limits{
+			MaxChirpLength: FreeChirpLength,
+			ChirpsPerHour:  30,
+		},
+	},
+	TierChirpyRed: {
+		Tier: TierChirpyRed,
+		Features: map[Feature]bool{
+			FeatureLongChirps:      true,
+			FeatureChirpEditing:    true,
+			FeatureScheduledChirps: true,
+		},
+		Limits: Limits{
+			MaxChirpLength:   1000,
+			ChirpsPerHour:    300,
+			MaxScheduleAhead: 30 * 24 * time.Hour,
+		},
+	},
+}
+
+// For returns the entitlements of user
+func For(user database.User) Entitlements {
+	if user.IsChirpyRed {
+		return plans[TierChirpyRed]
+	}
+	return plans[TierFree]
+}
+
+// Plan returns the entitlements that come with tier
+func Plan(tier Tier) Entitlements {
+	return plans[tier]
+}
+
+// Has reports whether the plan includes feature
+func (e Entitlements) Has(feature Feature) bool {
+	return e.Features[feature]
+}
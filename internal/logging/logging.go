@@ -0,0 +1,87 @@
+// Package logging carries a request-scoped slog.Logger and request ID
+// in the request context.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+type contextKey int
+
+const (
+	loggerContextKey contextKey = iota
+	requestContextKey
+)
+
+// RequestIDHeader is the header a request ID is read from and echoed in
+const RequestIDHeader = "X-Request-ID"
+
+// Request is what the access log needs to know about a request
+// that is only learned by inner handlers
+type Request struct {
+	ID     string
+	UserID int
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether a client-supplied request ID is safe to reuse.
+// IDs are limited to 128 letters, digits and ._:- so they can't forge log lines.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequest returns a copy of ctx carrying request and a logger that
+// tags every record with its ID
+func WithRequest(ctx context.Context, logger *slog.Logger, request *Request) context.Context {
+	ctx = context.WithValue(ctx, requestContextKey, request)
+	return WithLogger(ctx, logger.With("request_id", request.ID))
+}
+
+// RequestFromContext returns the request stored in ctx, if any
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	request, ok := ctx.Value(requestContextKey).(*Request)
+	return request, ok
+}
+
+// SetUser records the authenticated user of the request in ctx, and
+// returns a copy of ctx whose logger tags records with the user
+func SetUser(ctx context.Context, user_id int) context.Context {
+	if request, ok := RequestFromContext(ctx); ok {
+		request.UserID = user_id
+	}
+	return WithLogger(ctx, FromContext(ctx).With("user_id", user_id))
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerContextKey).(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+	return logger
+}
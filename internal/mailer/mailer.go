@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers a message through the configured SMTP server
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	err := smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{sanitizeHeader(msg.To)}, formatMessage(m.From, msg))
+	if err != nil {
+		return fmt.Errorf("couldn't send mail: %s", err)
+	}
+
+	return nil
+}
+
+// LogMailer writes messages to a writer instead of sending them,
+// for local development
+type LogMailer struct {
+	mux *sync.Mutex
+	w   io.Writer
+}
+
+// NewLogMailer creates a mailer that writes every message to w
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{
+		mux: &sync.Mutex{},
+		w:   w,
+	}
+}
+
+// Send writes a message to the underlying writer
+func (m *LogMailer) Send(msg Message) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "--- %s\n%s\n", time.Now().UTC().Format(time.RFC3339), formatMessage("chirpy", msg))
+	if err != nil {
+		return fmt.Errorf("couldn't write mail: %s", err)
+	}
+
+	return nil
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", sanitizeHeader(from))
+	fmt.Fprintf(&b, "To: %s\r\n", sanitizeHeader(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", sanitizeHeader(msg.Subject))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	b.WriteString("\r\n")
+
+	return []byte(b.String())
+}
+
+// sanitizeHeader strips line breaks so values can't inject extra headers
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,192 @@
+// Package metrics keeps counters, gauges and histograms that are safe for
+// concurrent use and writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are upper bounds in seconds suited to request latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counter is a value that only goes up until it is reset
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Reset sets the counter back to zero. Prometheus treats this like a restart.
+func (c *Counter) Reset() {
+	c.value.Store(0)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set replaces the value of the gauge
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	buckets []float64
+	// counts[i] counts observations <= buckets[i]; the last one is +Inf
+	counts  []atomic.Uint64
+	sumBits atomic.Uint64
+	count   atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+// Observe records one value
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + value
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// Count returns how many values were observed
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Sum returns the total of every observed value
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sumBits.Load())
+}
+
+// vec holds one child metric per combination of label values
+type vec[T any] struct {
+	labels   []string
+	newChild func() *T
+	mux      sync.RWMutex
+	children map[string]*T
+}
+
+func newVec[T any](labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		labels:   labels,
+		newChild: newChild,
+		children: make(map[string]*T),
+	}
+}
+
+// with returns the child for values, creating it on first use
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic("metrics: wrong number of label values")
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mux.RLock()
+	child, ok := v.children[key]
+	v.mux.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	child, ok = v.children[key]
+	if !ok {
+		child = v.newChild()
+		v.children[key] = child
+	}
+	return child
+}
+
+// each calls fn for every child, ordered by label values
+func (v *vec[T]) each(fn func(values []string, child *T)) {
+	type series struct {
+		values []string
+		child  *T
+	}
+
+	v.mux.RLock()
+	all := make([]series, 0, len(v.children))
+	for key, child := range v.children {
+		values := []string{}
+		if len(v.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		all = append(all, series{values: values, child: child})
+	}
+	v.mux.RUnlock()
+
+	// Compared label by label, since a separator inside the joined keys
+	// would sort "/a b" before "/a"
+	sort.Slice(all, func(i, j int) bool {
+		for k := range all[i].values {
+			if all[i].values[k] != all[j].values[k] {
+				return all[i].values[k] < all[j].values[k]
+			}
+		}
+		return false
+	})
+	for _, s := range all {
+		fn(s.values, s.child)
+	}
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// With returns the counter for the label values, in the order the labels were declared
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values)
+}
+
+// Each calls fn for every counter, ordered by label values
+func (c *CounterVec) Each(fn func(values []string, counter *Counter)) {
+	c.each(fn)
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+// With returns the histogram for the label values, in the order the labels were declared
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values)
+}
+
+// Each calls fn for every histogram, ordered by label values
+func (h *HistogramVec) Each(fn func(values []string, histogram *Histogram)) {
+	h.each(fn)
+}
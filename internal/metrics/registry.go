@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds named metrics and writes them out together
+type Registry struct {
+	mux      sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+type family struct {
+	name  string
+	help  string
+	kind  string
+	write func(w *bufio.Writer, name string)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+	}
+}
+
+func (r *Registry) register(f family) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.names[f.name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+	}
+	r.names[f.name] = true
+	r.families = append(r.families, f)
+}
+
+// NewCounter registers a counter without labels
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// NewCounterVec registers a family of counters partitioned by labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	counters := &CounterVec{newVec(labels, func() *Counter { return &Counter{} })}
+	r.register(family{
+		name: name,
+		help: help,
+		kind: "counter",
+		write: func(w *bufio.Writer, name string) {
+			counters.Each(func(values []string, counter *Counter) {
+				writeSample(w, name, labels, values, "", "", float64(counter.Value()))
+			})
+		},
+	})
+	return counters
+}
+
+// NewGauge registers a gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	gauge := &Gauge{}
+	r.register(family{
+		name: name,
+		help: help,
+		kind: "gauge",
+		write: func(w *bufio.Writer, name string) {
+			writeSample(w, name, nil, nil, "", "", gauge.Value())
+		},
+	})
+	return gauge
+}
+
+// NewHistogramVec registers a family of histograms partitioned by labels.
+// buckets are upper bounds in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	histograms := &HistogramVec{newVec(labels, func() *Histogram { return newHistogram(buckets) })}
+	r.register(family{
+		name: name,
+		help: help,
+		kind: "histogram",
+		write: func(w *bufio.Writer, name string) {
+			histograms.Each(func(values []string, histogram *Histogram) {
+				cumulative := uint64(0)
+				for i, bound := range buckets {
+					cumulative += histogram.counts[i].Load()
+					writeSample(w, name+"_bucket", labels, values, "le", formatFloat(bound), float64(cumulative))
+				}
+				cumulative += histogram.counts[len(buckets)].Load()
+				writeSample(w, name+"_bucket", labels, values, "le", "+Inf", float64(cumulative))
+				writeSample(w, name+"_sum", labels, values, "", "", histogram.Sum())
+				writeSample(w, name+"_count", labels, values, "", "", float64(cumulative))
+			})
+		},
+	})
+	return histograms
+}
+
+// WriteText writes every metric in the Prometheus text format
+func (r *Registry) WriteText(out io.Writer) error {
+	r.mux.Lock()
+	families := append([]family(nil), r.families...)
+	r.mux.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		f.write(w, f.name)
+	}
+	return w.Flush()
+}
+
+// Handler serves the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteText(w)
+	})
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra_label, extra_value string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra_label != "" {
+		pairs := make([]string, 0, len(labels)+1)
+		for i, label := range labels {
+			pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+		}
+		if extra_label != "" {
+			pairs = append(pairs, extra_label+`="`+extra_value+`"`)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTextGolden(t *testing.T) {
+	r := NewRegistry()
+
+	counters := r.NewCounterVec("test_requests_total", "Requests by path.\nSecond line with a \\ backslash.", "path", "status")
+	// Created out of order, written sorted by label values
+	counters.With("/b", "200").Inc()
+	counters.With(`/a "quoted"`+"\n"+`back\slash`, "500").Inc()
+	counters.With("/a", "200").Inc()
+	counters.With("/a", "200").Inc()
+
+	gauge := r.NewGauge("test_size_bytes", `Size with "quotes" kept as is.`)
+	gauge.Set(1.5)
+
+	histograms := r.NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	histograms.With("/y").Observe(0.05)
+	histograms.With("/y").Observe(0.1)
+	histograms.With("/y").Observe(0.5)
+	histograms.With("/y").Observe(3)
+	histograms.With("/x").Observe(2)
+
+	plain := r.NewCounter("test_plain_total", "No labels.")
+	plain.Inc()
+
+	want := `# HELP test_requests_total Requests by path.\nSecond line with a \\ backslash.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",status="200"} 2
+test_requests_total{path="/a \"quoted\"\nback\\slash",status="500"} 1
+test_requests_total{path="/b",status="200"} 1
+# HELP test_size_bytes Size with "quotes" kept as is.
+# TYPE test_size_bytes gauge
+test_size_bytes 1.5
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/x",le="0.1"} 0
+test_duration_seconds_bucket{route="/x",le="1"} 0
+test_duration_seconds_bucket{route="/x",le="+Inf"} 1
+test_duration_seconds_sum{route="/x"} 2
+test_duration_seconds_count{route="/x"} 1
+test_duration_seconds_bucket{route="/y",le="0.1"} 2
+test_duration_seconds_bucket{route="/y",le="1"} 3
+test_duration_seconds_bucket{route="/y",le="+Inf"} 4
+test_duration_seconds_sum{route="/y"} 3.65
+test_duration_seconds_count{route="/y"} 4
+# HELP test_plain_total No labels.
+# TYPE test_plain_total counter
+test_plain_total 1
+`
+
+	// Writing twice gives the same output
+	for i := 0; i < 2; i++ {
+		out := &strings.Builder{}
+		err := r.WriteText(out)
+		if err != nil {
+			t.Fatalf("WriteText: %v", err)
+		}
+		if out.String() != want {
+			t.Fatalf("WriteText wrote:\n%s\nwant:\n%s", out.String(), want)
+		}
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	histograms := r.NewHistogramVec("test_seconds", "Seconds.", []float64{1})
+	histograms.With().Observe(0.5)
+
+	want := `# HELP test_seconds Seconds.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="+Inf"} 1
+test_seconds_sum 0.5
+test_seconds_count 1
+`
+	out := &strings.Builder{}
+	err := r.WriteText(out)
+	if err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	if out.String() != want {
+		t.Fatalf("WriteText wrote:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice didn't panic")
+		}
+	}()
+	r.NewGauge("test_total", "Test.")
+}
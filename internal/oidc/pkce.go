@@ -0,0 +1,12 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// CodeChallenge derives the S256 PKCE challenge for a code verifier (RFC 7636)
+func CodeChallenge(code_verifier string) string {
+	sum := sha256.Sum256([]byte(code_verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,239 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Config describes a client registered with an OpenID Connect provider
+type Config struct {
+	// Name identifies the provider in routes and linked identities
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes defaults to openid, email and profile
+	Scopes []string
+	// HTTPClient is used for every request to the provider.
+	// It defaults to a client with a short timeout.
+	HTTPClient *http.Client
+}
+
+// Metadata is the part of the provider's discovery document Chirpy needs
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the ID token claims Chirpy uses
+type Claims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// Provider runs the authorization code flow against one provider.
+// Discovery and signing keys are fetched on first use and cached.
+type Provider struct {
+	cfg Config
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]interface{}
+}
+
+// NewProvider returns a provider for cfg without contacting it
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("name, issuer, client id and redirect url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+
+	return &Provider{cfg: cfg}, nil
+}
+
+// Name returns the name the provider was configured with
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// RedirectURL returns where the provider sends the user back to
+func (p *Provider) RedirectURL() string {
+	return p.cfg.RedirectURL
+}
+
+// Metadata returns the provider's discovery document
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	metadata := &Metadata{}
+	err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", metadata)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't discover provider: %w", err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("provider reported issuer %q, expected %q", metadata.Issuer, p.cfg.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	p.metadata = metadata
+	return metadata, nil
+}
+
+// AuthCodeURL returns the URL to send the user to for signing in.
+// code_verifier is bound to the request with PKCE (S256).
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, code_verifier string) (string, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	auth_url, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+
+	query := auth_url.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", p.cfg.RedirectURL)
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(code_verifier))
+	query.Set("code_challenge_method", "S256")
+	auth_url.RawQuery = query.Encode()
+
+	return auth_url.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified
+// claims of the ID token. The token must carry nonce.
+func (p *Provider) Exchange(ctx context.Context, code, code_verifier, nonce string) (*Claims, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", code_verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	token_response := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	err = p.doJSON(req, &token_response)
+	if err != nil {
+		if token_response.Error != "" {
+			return nil, fmt.Errorf("token endpoint: %s: %s", token_response.Error, token_response.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if token_response.IDToken == "" {
+		return nil, errors.New("token endpoint returned no id token")
+	}
+
+	return p.VerifyIDToken(ctx, token_response.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry
+// and nonce of an ID token and returns its claims
+func (p *Provider) VerifyIDToken(ctx context.Context, id_token, nonce string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(id_token, claims, func(token *jwt.Token) (interface{}, error) {
+		return p.verifyingKey(ctx, token)
+	},
+		jwt.WithValidMethods(supportedAlgorithms),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("invalid id token: missing subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return p.doJSON(req, v)
+}
+
+// doJSON sends req and decodes the response body into v.
+// Error responses are decoded too before an error is returned.
+func (p *Provider) doJSON(req *http.Request, v interface{}) error {
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	decode_err := json.Unmarshal(body, v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return decode_err
+}
@@ -0,0 +1,75 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachList looks passwords up in a local copy of a k-anonymity
+// breached-password list such as Have I Been Pwned's. The directory holds
+// one file per 5-character SHA-1 prefix, named <PREFIX>.txt, each listing
+// "SUFFIX:COUNT" lines exactly like the range API returns them.
+type BreachList struct {
+	dir string
+	// minCount is how often a password must have been seen to count
+	minCount int
+}
+
+// NewBreachList opens the breach list in dir
+func NewBreachList(dir string, min_count int) (*BreachList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if min_count < 1 {
+		min_count = 1
+	}
+
+	return &BreachList{dir: dir, minCount: min_count}, nil
+}
+
+// Count returns how often password has been seen in breaches,
+// or zero if it is below the minimum count
+func (b *BreachList) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line_suffix, count_string, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || !strings.EqualFold(line_suffix, suffix) {
+			continue
+		}
+
+		count, err := strconv.Atoi(count_string)
+		if err != nil {
+			return 0, fmt.Errorf("invalid count in %s.txt: %w", prefix, err)
+		}
+		if count < b.minCount {
+			return 0, nil
+		}
+		return count, nil
+	}
+
+	return 0, scanner.Err()
+}
@@ -0,0 +1,202 @@
+package password
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var tracer = otel.Tracer("github.com/Hien-Trinh/chirpy/internal/password")
+
+// ErrUnknownHash is returned for stored hashes in a format no algorithm recognises
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Argon2idParams tunes Argon2id (RFC 9106)
+type Argon2idParams struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams are OWASP's recommended minimum for Argon2id
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Hasher hashes new passwords with Argon2id and verifies hashes made by
+// any supported algorithm. Hashes are stored as PHC strings such as
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>; bcrypt hashes keep
+// their $2a$ form.
+type Hasher struct {
+	Argon2id Argon2idParams
+}
+
+// NewHasher returns a hasher that hashes with params,
+// or an error if Argon2id can't run with them
+func NewHasher(params Argon2idParams) (*Hasher, error) {
+	err := params.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Hasher{Argon2id: params}, nil
+}
+
+// validate checks params against the limits of RFC 9106 section 3.1
+func (params Argon2idParams) validate() error {
+	switch {
+	case params.Parallelism < 1:
+		return errors.New("argon2 parallelism must be at least 1")
+	case params.Memory < 8*uint32(params.Parallelism):
+		return fmt.Errorf("argon2 memory must be at least 8 KiB per lane, %d KiB for parallelism %d", 8*uint32(params.Parallelism), params.Parallelism)
+	case params.Iterations < 1:
+		return errors.New("argon2 iterations must be at least 1")
+	case params.SaltLength < 8:
+		return errors.New("argon2 salt must be at least 8 bytes")
+	case params.KeyLength < 4:
+		return errors.New("argon2 key must be at least 4 bytes")
+	}
+
+	return nil
+}
+
+// Hash returns the PHC string of password
+func (h *Hasher) Hash(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "Hasher.Hash")
+	defer span.End()
+	span.SetAttributes(attribute.String("password.algorithm", "argon2id"))
+
+	salt := make([]byte, h.Argon2id.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Argon2id.Iterations, h.Argon2id.Memory, h.Argon2id.Parallelism, h.Argon2id.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Argon2id.Memory,
+		h.Argon2id.Iterations,
+		h.Argon2id.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether password matches the stored hash.
+// An error means the hash itself couldn't be read.
+func (h *Hasher) Verify(ctx context.Context, password, hash string) (bool, error) {
+	_, span := tracer.Start(ctx, "Hasher.Verify")
+	defer span.End()
+	span.SetAttributes(attribute.String("password.algorithm", algorithm(hash)))
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// NeedsRehash reports whether hash was made with another algorithm
+// or weaker parameters than new hashes get
+func (h *Hasher) NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return true
+	}
+
+	params, salt, _, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != h.Argon2id.Memory ||
+		params.Iterations != h.Argon2id.Iterations ||
+		params.Parallelism != h.Argon2id.Parallelism ||
+		params.KeyLength != h.Argon2id.KeyLength ||
+		uint32(len(salt)) != h.Argon2id.SaltLength
+}
+
+func decodeArgon2id(hash string) (Argon2idParams, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return Argon2idParams{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	params := Argon2idParams{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	// Argon2id panics on parameters it can't run with
+	err = params.validate()
+	if err != nil {
+		return Argon2idParams{}, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+// algorithm names the algorithm hash was made with, for traces
+func algorithm(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return "argon2id"
+	case isBcrypt(hash):
+		return "bcrypt"
+	default:
+		return "unknown"
+	}
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
@@ -0,0 +1,243 @@
+package password
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testParams are cheap enough to keep the tests fast
+var testParams = Argon2idParams{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func newTestHasher(t *testing.T, params Argon2idParams) *Hasher {
+	t.Helper()
+
+	h, err := NewHasher(params)
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+	return h
+}
+
+func TestNewHasherValidatesParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *Argon2idParams)
+		ok     bool
+	}{
+		{"valid", func(p *Argon2idParams) {}, true},
+		{"max parallelism", func(p *Argon2idParams) { p.Parallelism = 255; p.Memory = 8 * 255 }, true},
+		{"zero parallelism", func(p *Argon2idParams) { p.Parallelism = 0 }, false},
+		{"too little memory", func(p *Argon2idParams) { p.Memory = 7 }, false},
+		{"too little memory per lane", func(p *Argon2idParams) { p.Parallelism = 4; p.Memory = 31 }, false},
+		{"zero iterations", func(p *Argon2idParams) { p.Iterations = 0 }, false},
+		{"zero salt length", func(p *Argon2idParams) { p.SaltLength = 0 }, false},
+		{"short salt", func(p *Argon2idParams) { p.SaltLength = 7 }, false},
+		{"zero key length", func(p *Argon2idParams) { p.KeyLength = 0 }, false},
+	}
+
+	for _, tc := range tests {
+		params := testParams
+		tc.modify(&params)
+
+		_, err := NewHasher(params)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: NewHasher(%+v) error = %v, want ok %v", tc.name, params, err, tc.ok)
+		}
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHasher(t, testParams)
+
+	hash, err := h.Hash(ctx, "correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Hash = %q, want a PHC string with the hasher's parameters", hash)
+	}
+
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		t.Fatalf("decodeArgon2id: %v", err)
+	}
+	if params != testParams {
+		t.Errorf("decoded params = %+v, want %+v", params, testParams)
+	}
+	if len(salt) != 16 || len(key) != 32 {
+		t.Errorf("decoded %d byte salt and %d byte key, want 16 and 32", len(salt), len(key))
+	}
+
+	other, err := h.Hash(ctx, "correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if other == hash {
+		t.Error("hashing twice gave the same hash, want a fresh salt each time")
+	}
+
+	for _, tc := range []struct {
+		password string
+		want     bool
+	}{
+		{"correct horse", true},
+		{"correct horse ", false},
+		{"Correct horse", false},
+		{"", false},
+	} {
+		ok, err := h.Verify(ctx, tc.password, hash)
+		if err != nil {
+			t.Fatalf("Verify(%q): %v", tc.password, err)
+		}
+		if ok != tc.want {
+			t.Errorf("Verify(%q) = %v, want %v", tc.password, ok, tc.want)
+		}
+	}
+}
+
+func TestVerifyUsesStoredParams(t *testing.T) {
+	ctx := context.Background()
+
+	old := newTestHasher(t, testParams)
+	hash, err := old.Hash(ctx, "correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	stronger := testParams
+	stronger.Iterations = 2
+	h := newTestHasher(t, stronger)
+
+	ok, err := h.Verify(ctx, "correct horse", hash)
+	if err != nil || !ok {
+		t.Errorf("Verify with newer params = %v, %v, want true", ok, err)
+	}
+}
+
+func TestDecodeArgon2idMalformed(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"too few parts", "$argon2id$v=19$m=1024,t=1,p=1$" + salt},
+		{"too many parts", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + key + "$extra"},
+		{"old version", "$argon2id$v=16$m=1024,t=1,p=1$" + salt + "$" + key},
+		{"missing version", "$argon2id$m=1024,t=1,p=1$" + salt + "$" + key + "$"},
+		{"garbled params", "$argon2id$v=19$m=lots,t=1,p=1$" + salt + "$" + key},
+		{"missing param", "$argon2id$v=19$m=1024,t=1$" + salt + "$" + key},
+		{"parallelism overflows", "$argon2id$v=19$m=1024,t=1,p=256$" + salt + "$" + key},
+		{"zero parallelism", "$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key},
+		{"zero iterations", "$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key},
+		{"too little memory", "$argon2id$v=19$m=4,t=1,p=1$" + salt + "$" + key},
+		{"salt not base64", "$argon2id$v=19$m=1024,t=1,p=1$not*base64$" + key},
+		{"empty salt", "$argon2id$v=19$m=1024,t=1,p=1$$" + key},
+		{"key not base64", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$not*base64"},
+		{"empty key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$"},
+	}
+
+	ctx := context.Background()
+	h := newTestHasher(t, testParams)
+
+	for _, tc := range tests {
+		_, _, _, err := decodeArgon2id(tc.hash)
+		if err == nil {
+			t.Errorf("%s: decodeArgon2id(%q) succeeded, want an error", tc.name, tc.hash)
+		}
+
+		ok, err := h.Verify(ctx, "correct horse", tc.hash)
+		if ok || err == nil {
+			t.Errorf("%s: Verify = %v, %v, want false and an error", tc.name, ok, err)
+		}
+
+		if !h.NeedsRehash(tc.hash) {
+			t.Errorf("%s: NeedsRehash = false, want true", tc.name)
+		}
+	}
+}
+
+func TestVerifyUnknownHash(t *testing.T) {
+	h := newTestHasher(t, testParams)
+
+	for _, hash := range []string{"", "correct horse", "$1$salt$hash", "$scrypt$ln=15,r=8,p=1$salt$hash"} {
+		ok, err := h.Verify(context.Background(), "correct horse", hash)
+		if ok || !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("Verify(%q) = %v, %v, want false and ErrUnknownHash", hash, ok, err)
+		}
+	}
+}
+
+func TestVerifyBcrypt(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHasher(t, testParams)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	ok, err := h.Verify(ctx, "correct horse", string(hash))
+	if err != nil || !ok {
+		t.Errorf("Verify(right password) = %v, %v, want true", ok, err)
+	}
+
+	ok, err = h.Verify(ctx, "wrong horse", string(hash))
+	if err != nil || ok {
+		t.Errorf("Verify(wrong password) = %v, %v, want false", ok, err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHasher(t, testParams)
+
+	current, err := h.Hash(ctx, "correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	bcrypt_hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Argon2idParams)
+		want   bool
+	}{
+		{"same params", func(p *Argon2idParams) {}, false},
+		{"more memory", func(p *Argon2idParams) { p.Memory *= 2 }, true},
+		{"more iterations", func(p *Argon2idParams) { p.Iterations++ }, true},
+		{"more parallelism", func(p *Argon2idParams) { p.Parallelism++ }, true},
+		{"longer salt", func(p *Argon2idParams) { p.SaltLength *= 2 }, true},
+		{"longer key", func(p *Argon2idParams) { p.KeyLength *= 2 }, true},
+	}
+
+	for _, tc := range tests {
+		params := testParams
+		tc.modify(&params)
+
+		got := newTestHasher(t, params).NeedsRehash(current)
+		if got != tc.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if !h.NeedsRehash(string(bcrypt_hash)) {
+		t.Error("NeedsRehash(bcrypt) = false, want true")
+	}
+}
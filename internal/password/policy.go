@@ -0,0 +1,99 @@
+package password
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Violation is one way a password fails the policy
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Policy describes which passwords are accepted
+type Policy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// MaxBytes is the maximum length in bytes. It must stay at 72 or
+	// below while passwords are hashed with bcrypt, which can't hash
+	// anything longer; Argon2id only needs a bound on the work per request.
+	MaxBytes int
+	// MinClasses is how many of lowercase letters, uppercase letters,
+	// digits and symbols the password must mix
+	MinClasses int
+	// Breaches is consulted for passwords known from data breaches, if set
+	Breaches *BreachList
+}
+
+// DefaultPolicy follows NIST SP 800-63B: a minimum length and a
+// breach check matter, composition rules mostly don't
+var DefaultPolicy = Policy{
+	MinLength: 8,
+	MaxBytes:  1024,
+}
+
+// Check returns every way password fails the policy.
+// An error means the breach list couldn't be read.
+func (p Policy) Check(password string) ([]Violation, error) {
+	violations := make([]Violation, 0)
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, Violation{
+			Code:    "too_short",
+			Message: fmt.Sprintf("Password must be at least %d characters", p.MinLength),
+		})
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, Violation{
+			Code:    "too_long",
+			Message: fmt.Sprintf("Password must be at most %d bytes", p.MaxBytes),
+		})
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, Violation{
+			Code:    "too_simple",
+			Message: fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses),
+		})
+	}
+
+	if p.Breaches != nil {
+		count, err := p.Breaches.Count(password)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			violations = append(violations, Violation{
+				Code:    "breached",
+				Message: "Password has appeared in a data breach",
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
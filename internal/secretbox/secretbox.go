@@ -0,0 +1,79 @@
+// Package secretbox encrypts small secrets for storage with AES-256-GCM
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const KeySize = 32
+
+// ParseKey decodes a hex encoded 256-bit key
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode key: %s", err)
+	}
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes", KeySize)
+	}
+
+	return key, nil
+}
+
+// Seal encrypts plaintext and returns the nonce and ciphertext base64 encoded
+func Seal(key []byte, plaintext string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate nonce: %s", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal
+func Open(key []byte, sealed string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	dat, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode secret: %s", err)
+	}
+
+	if len(dat) < aead.NonceSize() {
+		return "", errors.New("secret is too short")
+	}
+
+	plaintext, err := aead.Open(nil, dat[:aead.NonceSize()], dat[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decrypt secret: %s", err)
+	}
+
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
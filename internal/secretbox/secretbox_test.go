@@ -0,0 +1,91 @@
+package secretbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestSealOpen(t *testing.T) {
+	key := testKey(1)
+
+	sealed, err := Seal(key, "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	again, err := Seal(key, "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if sealed == again {
+		t.Fatal("sealing twice gave the same ciphertext")
+	}
+
+	plaintext, err := Open(key, sealed)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if plaintext != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("Open() = %q, want the sealed secret", plaintext)
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	key := testKey(1)
+
+	sealed, err := Seal(key, "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	dat, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatalf("decoding sealed secret: %v", err)
+	}
+
+	flip := func(i int) string {
+		tampered := bytes.Clone(dat)
+		tampered[i] ^= 1
+		return base64.StdEncoding.EncodeToString(tampered)
+	}
+
+	tests := []struct {
+		name   string
+		key    []byte
+		sealed string
+	}{
+		{"nonce", key, flip(0)},
+		{"ciphertext", key, flip(len(dat) / 2)},
+		{"tag", key, flip(len(dat) - 1)},
+		{"truncated", key, base64.StdEncoding.EncodeToString(dat[:8])},
+		{"not base64", key, "!!!"},
+		{"wrong key", testKey(2), sealed},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Open(tc.key, tc.sealed)
+			if err == nil {
+				t.Fatal("Open accepted a tampered secret")
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	_, err := ParseKey("00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff")
+	if err != nil {
+		t.Fatalf("ParseKey: %v", err)
+	}
+
+	for _, s := range []string{"", "0011", "zz112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"} {
+		_, err := ParseKey(s)
+		if err == nil {
+			t.Errorf("ParseKey(%q) accepted a bad key", s)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package signature signs and verifies webhook payloads with HMAC-SHA256.
+// A signature header looks like "t=1700000000,v1=<hex>", where the MAC
+// covers "<t>.<body>" so that a captured request can't be replayed later.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissing   = errors.New("signature is missing")
+	ErrMalformed = errors.New("signature is malformed")
+	ErrExpired   = errors.New("signature timestamp is outside the tolerance")
+	ErrMismatch  = errors.New("signature doesn't match")
+)
+
+// Sign returns the signature header for body sent at t
+func Sign(secret, body []byte, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac(secret, timestamp, body)))
+}
+
+// Verify checks a signature header against body. The timestamp must be
+// within tolerance of now. Several v1 values are allowed so that secrets
+// can be rotated.
+func Verify(header string, secret, body []byte, tolerance time.Duration, now time.Time) error {
+	if header == "" {
+		return ErrMissing
+	}
+
+	timestamp := ""
+	signatures := make([][]byte, 0, 1)
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrMalformed
+		}
+
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrMalformed
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return ErrMalformed
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	expected := mac(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+
+	return ErrMismatch
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,27 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Generate returns a hex encoded 256-bit random token
+func Generate() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate token: %s", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Hash returns the hex encoded SHA-256 digest of a token.
+// Tokens are random, so a fast unsalted digest is enough to keep
+// them from being usable if the database leaks.
+func Hash(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
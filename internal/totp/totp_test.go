@@ -0,0 +1,104 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 Appendix B, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tc := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", tc.unix, err)
+		}
+		if got != tc.want {
+			t.Errorf("Code(%d) = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{"current step", 0, true},
+		{"previous step", -1, true},
+		{"next step", 1, true},
+		{"two steps ago", -2, false},
+		{"two steps ahead", 2, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, step+tc.offset)
+			if err != nil {
+				t.Fatalf("Code: %v", err)
+			}
+
+			matched, ok := Validate(rfcSecret, code, now, 0)
+			if ok != tc.ok {
+				t.Fatalf("Validate() ok = %v, want %v", ok, tc.ok)
+			}
+			if ok && matched != step+tc.offset {
+				t.Fatalf("Validate() step = %d, want %d", matched, step+tc.offset)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsUsedStep(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	code, err := Code(rfcSecret, step)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+
+	_, ok := Validate(rfcSecret, code, now, step)
+	if ok {
+		t.Fatal("code from the last used step was accepted again")
+	}
+
+	// A later code still works after an earlier one was used
+	next, err := Code(rfcSecret, step+1)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	_, ok = Validate(rfcSecret, next, now, step)
+	if !ok {
+		t.Fatal("code from the next step was rejected")
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		_, ok := Validate(rfcSecret, code, now, 0)
+		if ok {
+			t.Errorf("Validate(%q) accepted a malformed code", code)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are exported with
+// OTLP over HTTP, configured by the standard OTEL_* environment variables,
+// and trace context is propagated with W3C traceparent headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// NewExporter returns the exporter OTEL_TRACES_EXPORTER asks for: "otlp",
+// or "none". Unset, it is "otlp" when an OTLP endpoint is configured and
+// "none" otherwise. A nil exporter means tracing is off.
+func NewExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	name := os.Getenv("OTEL_TRACES_EXPORTER")
+	if name == "" {
+		name = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			name = "otlp"
+		}
+	}
+
+	switch name {
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+	}
+}
+
+// Setup installs W3C trace context propagation and, unless exporter is
+// nil, a global tracer provider that batches spans to exporter. Resource
+// attributes come from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES,
+// defaulting the service name to service_name. The returned function
+// flushes buffered spans and must be called before exiting.
+func Setup(ctx context.Context, exporter sdktrace.SpanExporter, service_name string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(service_name)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sampler defaults to OTEL_TRACES_SAMPLER
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,249 @@
+// Package webhooks delivers events to the webhook endpoints users register.
+// Deliveries are queued in the database, so they survive restarts, and
+// are retried with exponential backoff until they are dead-lettered.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/signature"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/Hien-Trinh/chirpy/internal/webhooks")
+
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpDeleted = "chirp.deleted"
+	EventUserUpgraded = "user.upgraded"
+)
+
+// Events lists every event endpoints can subscribe to
+var Events = []string{EventChirpCreated, EventChirpDeleted, EventUserUpgraded}
+
+// ValidEvent reports whether event is one endpoints can subscribe to
+func ValidEvent(event string) bool {
+	for _, valid := range Events {
+		if event == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Config tunes delivery
+type Config struct {
+	// MaxAttempts is how often a delivery is tried before it is dead-lettered
+	MaxAttempts int
+	// BaseDelay is the wait after the first failure; it doubles after each one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Interval is how often the queue is checked when nothing wakes the dispatcher
+	Interval time.Duration
+	// AllowPrivateNetworks lets endpoints resolve to loopback and private
+	// addresses, which is only safe in development and tests
+	AllowPrivateNetworks bool
+	// HTTPClient sends deliveries. By default it times out after 10 seconds
+	// and refuses private addresses unless AllowPrivateNetworks is set.
+	HTTPClient *http.Client
+}
+
+// Dispatcher sends queued deliveries
+type Dispatcher struct {
+	db     *database.DB
+	cfg    Config
+	wakeup chan struct{}
+}
+
+// NewDispatcher returns a dispatcher for the deliveries queued in db
+func NewDispatcher(db *database.DB, cfg Config) *Dispatcher {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = 30 * time.Second
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = 6 * time.Hour
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = newHTTPClient(cfg.AllowPrivateNetworks)
+	}
+
+	return &Dispatcher{
+		db:     db,
+		cfg:    cfg,
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the dispatcher up to send newly queued deliveries
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is done, then returns once the
+// delivery in progress, if any, is finished
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wakeup:
+		}
+	}
+}
+
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := d.db.GetDueWebhookDeliveries(ctx, time.Now(), 50)
+		if err != nil {
+			log.Printf("Couldn't get webhook deliveries: %s", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+
+		for _, delivery := range deliveries {
+			if ctx.Err() != nil {
+				return
+			}
+			d.deliver(ctx, delivery)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery database.WebhookDelivery) {
+	ctx, span := tracer.Start(ctx, "Dispatcher.deliver", trace.WithAttributes(
+		attribute.Int("webhook.delivery.id", delivery.Id),
+		attribute.String("webhook.event", delivery.Event),
+		attribute.Int("webhook.attempt", delivery.Attempts+1),
+	))
+	defer span.End()
+
+	attempt := database.WebhookAttempt{At: time.Now().UTC()}
+
+	endpoint, err := d.db.GetWebhookEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		// A delivery that has started is finished even when Run is stopped,
+		// rather than counted as a failed attempt; the client's timeout bounds it
+		attempt.StatusCode, err = d.send(context.WithoutCancel(ctx), endpoint, delivery)
+		if err != nil {
+			attempt.Error = err.Error()
+		} else {
+			attempt.Delivered = true
+		}
+	}
+
+	if !attempt.Delivered {
+		span.SetStatus(codes.Error, attempt.Error)
+	}
+	if !attempt.Delivered && delivery.Attempts+1 < d.cfg.MaxAttempts {
+		attempt.NextAttemptAt = attempt.At.Add(d.backoff(delivery.Attempts + 1))
+	}
+
+	_, err = d.db.RecordWebhookAttempt(ctx, delivery.Id, attempt)
+	if err != nil {
+		log.Printf("Couldn't record webhook delivery %d: %s", delivery.Id, err)
+	}
+}
+
+// send posts a delivery to its endpoint, signed with the endpoint's secret
+func (d *Dispatcher) send(ctx context.Context, endpoint database.WebhookEndpoint, delivery database.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1.0")
+	req.Header.Set("Chirpy-Event", delivery.Event)
+	req.Header.Set("Chirpy-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("Chirpy-Signature", signature.Sign([]byte(endpoint.Secret), body, time.Now()))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := d.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// backoff returns how long to wait after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := float64(d.cfg.BaseDelay) * math.Pow(2, float64(attempts-1))
+	return time.Duration(math.Min(delay, float64(d.cfg.MaxDelay)))
+}
+
+var errPrivateAddress = errors.New("endpoint resolves to a private address")
+
+// newHTTPClient returns a client that, unless allow_private is set, refuses to
+// connect to loopback, private and link-local addresses so that endpoints
+// can't be used to reach internal services
+func newHTTPClient(allow_private bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allow_private {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,235 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/signature"
+)
+
+const testSecret = "whsec_test"
+
+// receiver is a webhook endpoint that records what it is sent
+type receiver struct {
+	server *httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	t.Helper()
+
+	rcv := &receiver{status: status}
+	rcv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rcv.mu.Lock()
+		rcv.requests = append(rcv.requests, r)
+		rcv.bodies = append(rcv.bodies, body)
+		rcv.mu.Unlock()
+
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(rcv.server.Close)
+
+	return rcv
+}
+
+func (rcv *receiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.requests)
+}
+
+// queueDelivery registers an endpoint at url and queues one event for it
+func queueDelivery(t *testing.T, db *database.DB, url string) database.WebhookEndpoint {
+	t.Helper()
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, "user@example.com", "", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	endpoint, err := db.CreateWebhookEndpoint(ctx, user.Id, url, testSecret, []string{EventChirpCreated})
+	if err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+	queued, err := db.EnqueueWebhookEvent(ctx, EventChirpCreated, user.Id, `{"id":1}`)
+	if err != nil || queued != 1 {
+		t.Fatalf("EnqueueWebhookEvent = %d, %v, want 1 queued", queued, err)
+	}
+
+	return endpoint
+}
+
+// onlyDelivery returns the single delivery queued for endpoint
+func onlyDelivery(t *testing.T, db *database.DB, endpoint database.WebhookEndpoint) database.WebhookDelivery {
+	t.Helper()
+
+	deliveries, err := db.GetWebhookDeliveriesByEndpoint(context.Background(), endpoint.Id, 10)
+	if err != nil {
+		t.Fatalf("GetWebhookDeliveriesByEndpoint: %v", err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	return db
+}
+
+func TestDeliverSignsRequests(t *testing.T) {
+	db := newTestDB(t)
+	rcv := newReceiver(t, http.StatusNoContent)
+	endpoint := queueDelivery(t, db, rcv.server.URL)
+
+	d := NewDispatcher(db, Config{AllowPrivateNetworks: true})
+	d.deliverDue(context.Background())
+
+	if rcv.count() != 1 {
+		t.Fatalf("receiver got %d requests, want 1", rcv.count())
+	}
+	req, body := rcv.requests[0], rcv.bodies[0]
+	if string(body) != `{"id":1}` {
+		t.Fatalf("body = %s, want the queued payload", body)
+	}
+	if req.Header.Get("Chirpy-Event") != EventChirpCreated {
+		t.Fatalf("Chirpy-Event = %q, want %q", req.Header.Get("Chirpy-Event"), EventChirpCreated)
+	}
+	err := signature.Verify(req.Header.Get("Chirpy-Signature"), []byte(testSecret), body, time.Minute, time.Now())
+	if err != nil {
+		t.Fatalf("signature doesn't verify: %v", err)
+	}
+	err = signature.Verify(req.Header.Get("Chirpy-Signature"), []byte("other-secret"), body, time.Minute, time.Now())
+	if !errors.Is(err, signature.ErrMismatch) {
+		t.Fatalf("signature verified with another secret: %v", err)
+	}
+
+	delivery := onlyDelivery(t, db, endpoint)
+	if req.Header.Get("Chirpy-Delivery") != strconv.Itoa(delivery.Id) {
+		t.Fatalf("Chirpy-Delivery = %q, want %d", req.Header.Get("Chirpy-Delivery"), delivery.Id)
+	}
+	if delivery.Status != database.WebhookDeliveryDelivered || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusNoContent {
+		t.Fatalf("delivery = %+v, want delivered on the first attempt", delivery)
+	}
+}
+
+func TestDeliverBacksOffAfterFailure(t *testing.T) {
+	db := newTestDB(t)
+	rcv := newReceiver(t, http.StatusInternalServerError)
+	endpoint := queueDelivery(t, db, rcv.server.URL)
+
+	d := NewDispatcher(db, Config{AllowPrivateNetworks: true, BaseDelay: time.Minute})
+	d.deliverDue(context.Background())
+	// Not due again yet
+	d.deliverDue(context.Background())
+
+	if rcv.count() != 1 {
+		t.Fatalf("receiver got %d requests, want 1", rcv.count())
+	}
+	delivery := onlyDelivery(t, db, endpoint)
+	if delivery.Status != database.WebhookDeliveryPending || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("delivery = %+v, want pending after one failed attempt", delivery)
+	}
+	if wait := delivery.NextAttemptAt.Sub(delivery.LastAttemptAt); wait != time.Minute {
+		t.Fatalf("next attempt in %s, want %s", wait, time.Minute)
+	}
+}
+
+func TestDeliverDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	rcv := newReceiver(t, http.StatusBadGateway)
+	endpoint := queueDelivery(t, db, rcv.server.URL)
+
+	// A nanosecond of backoff makes every retry due right away
+	d := NewDispatcher(db, Config{AllowPrivateNetworks: true, MaxAttempts: 3, BaseDelay: time.Nanosecond})
+	d.deliverDue(context.Background())
+
+	if rcv.count() != 3 {
+		t.Fatalf("receiver got %d requests, want 3", rcv.count())
+	}
+	delivery := onlyDelivery(t, db, endpoint)
+	if delivery.Status != database.WebhookDeliveryDead || delivery.Attempts != 3 {
+		t.Fatalf("delivery = %+v, want dead after 3 attempts", delivery)
+	}
+
+	// Dead deliveries are left alone until they are retried by hand
+	d.deliverDue(context.Background())
+	if rcv.count() != 3 {
+		t.Fatalf("dead delivery was sent again")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(nil, Config{BaseDelay: 30 * time.Second, MaxDelay: time.Hour})
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+
+	for _, tc := range tests {
+		if got := d.backoff(tc.attempts); got != tc.want {
+			t.Errorf("backoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestDeliverRefusesPrivateAddresses(t *testing.T) {
+	db := newTestDB(t)
+	rcv := newReceiver(t, http.StatusNoContent)
+	endpoint := queueDelivery(t, db, rcv.server.URL)
+
+	d := NewDispatcher(db, Config{})
+	d.deliverDue(context.Background())
+
+	if rcv.count() != 0 {
+		t.Fatalf("receiver on a loopback address got %d requests", rcv.count())
+	}
+	delivery := onlyDelivery(t, db, endpoint)
+	if delivery.Status != database.WebhookDeliveryPending || delivery.LastError == "" {
+		t.Fatalf("delivery = %+v, want a failed attempt", delivery)
+	}
+}
+
+func TestHTTPClientRefusesPrivateAddresses(t *testing.T) {
+	rcv := newReceiver(t, http.StatusNoContent)
+
+	_, err := newHTTPClient(false).Get(rcv.server.URL)
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("Get() error = %v, want %v", err, errPrivateAddress)
+	}
+
+	resp, err := newHTTPClient(true).Get(rcv.server.URL)
+	if err != nil {
+		t.Fatalf("Get() with private networks allowed: %v", err)
+	}
+	resp.Body.Close()
+}
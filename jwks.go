@@ -0,0 +1,9 @@
+package main
+
+import "net/http"
+
+// handlerJWKS publishes the public keys access tokens can be verified with
+func (a *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, a.jwtKeys.JWKS())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// middlewareLog gives every request an ID, echoed in X-Request-ID, and a
+// logger in its context, then writes one access log line per request.
+// A well-formed X-Request-ID from the client is kept so requests can be
+// traced across services.
+func (a *apiConfig) middlewareLog(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		request := &logging.Request{ID: r.Header.Get(logging.RequestIDHeader)}
+		if !logging.ValidRequestID(request.ID) {
+			request.ID = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, request.ID)
+		ctx := logging.WithRequest(r.Context(), a.logger, request)
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			ctx = logging.WithLogger(ctx, logging.FromContext(ctx).With("trace_id", span.TraceID().String()))
+		}
+
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", routePattern(mux, r)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", recorder.bytes),
+		}
+		if request.UserID != 0 {
+			attrs = append(attrs, slog.Int("user_id", request.UserID))
+		}
+		logging.FromContext(ctx).LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// requestID returns the ID middlewareLog gave the request being answered on w
+func requestID(w http.ResponseWriter) string {
+	return w.Header().Get(logging.RequestIDHeader)
+}
+
+// newLogger configures logging from LOG_FORMAT ("text" or "json") and
+// LOG_LEVEL ("debug", "info", "warn" or "error")
+func newLogger() (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		err := level.UnmarshalText([]byte(value))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+}
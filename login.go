@@ -1,16 +1,14 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/logging"
+	"github.com/Hien-Trinh/chirpy/internal/token"
 )
 
 func (a *apiConfig) handlerLoginPost(w http.ResponseWriter, r *http.Request) {
@@ -32,62 +30,128 @@ func (a *apiConfig) handlerLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := a.db.GetUsers()
+	retry_after, err := a.reserveLoginAttempt(r, params.Email)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get users: %s", err))
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't check login attempts: %s", err))
+		return
+	}
+	if retry_after > 0 {
+		respondWithLoginThrottled(w, retry_after)
+		return
+	}
+
+	user, err := a.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil {
+		// Compare anyway so unknown emails take as long as wrong passwords
+		a.passwordHasher.Verify(r.Context(), params.Password, a.dummyPasswordHash)
+		a.respondWithFailedLogin(w, r, params.Email, 0, "unknown_email")
+		return
+	}
+
+	if !a.passwordMatches(r.Context(), user, params.Password) {
+		a.respondWithFailedLogin(w, r, params.Email, user.Id, "wrong_password")
+		return
+	}
+
+	err = a.releaseLoginAttempt(r, params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't release login attempt: %s", err))
 		return
 	}
 
-	for _, user := range users {
-		if user.Email == params.Email {
-			if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password)) == nil {
-				token_expiry := time.Hour
-				refresh_token_expiry := time.Hour * 24 * 60
-
-				claims := jwt.RegisteredClaims{
-					ExpiresAt: jwt.NewNumericDate(time.Now().Add(token_expiry).UTC()),
-					IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-					Issuer:    "chirpy",
-					Subject:   strconv.Itoa(user.Id),
-				}
-				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-				token_signed, err := token.SignedString([]byte(a.jwtSecret))
-				if err != nil {
-					respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
-					return
-				}
-
-				refresh_token_int, err := rand.Read(make([]byte, 32))
-				if err != nil {
-					respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create refresh token: %s", err))
-					return
-				}
-				refresh_token_string := hex.EncodeToString([]byte(strconv.Itoa(refresh_token_int)))
-				_, err = a.db.CreateRefreshToken(user.Id, refresh_token_string, time.Now().Add(refresh_token_expiry).UTC())
-				if err != nil {
-					respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create refresh token: %s", err))
-					return
-				}
-
-				user_without_password := struct {
-					Id           int    `json:"id"`
-					Email        string `json:"email"`
-					IsChirpyRed  bool   `json:"is_chirpy_red"`
-					Token        string `json:"token"`
-					RefreshToken string `json:"refresh_token"`
-				}{
-					Id:           user.Id,
-					Email:        user.Email,
-					IsChirpyRed:  user.IsChirpyRed,
-					Token:        token_signed,
-					RefreshToken: refresh_token_string,
-				}
-
-				respondWithJSON(w, http.StatusOK, user_without_password)
-				return
-			}
+	if a.passwordHasher.NeedsRehash(user.Password) {
+		// The password is only ever in hand at login, so upgrade old hashes now
+		hashed_password, err := a.passwordHash(r.Context(), params.Password)
+		if err == nil {
+			_, err = a.db.UpdateUserPassword(r.Context(), user.Id, hashed_password)
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Couldn't rehash password", "user_id", user.Id, "error", err)
 		}
 	}
 
+	a.respondWithLogin(w, r, user)
+}
+
+// respondWithFailedLogin records a failed login and rejects it
+func (a *apiConfig) respondWithFailedLogin(w http.ResponseWriter, r *http.Request, email string, user_id int, reason string) {
+	err := a.recordFailedLogin(r, email, user_id, reason)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't record login attempt: %s", err))
+		return
+	}
+
 	respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 }
+
+// respondWithLogin finishes the first step of a login. Users with
+// two-factor authentication get a challenge instead of a session.
+func (a *apiConfig) respondWithLogin(w http.ResponseWriter, r *http.Request, user database.User) {
+	if user.TOTPEnabled {
+		challenge_token, err := a.tokens.CreateChallenge(user.Id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			ChallengeToken    string `json:"challenge_token"`
+		}{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge_token,
+		})
+		return
+	}
+
+	a.respondWithSession(w, r, user)
+}
+
+// respondWithSession starts a new session for a user who has fully
+// authenticated and responds with its access and refresh tokens
+func (a *apiConfig) respondWithSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	refresh_token_expiry := time.Hour * 24 * 60
+
+	// Only a finished login forgives earlier failures; a correct password
+	// alone must not reset the count of guessed second factors
+	err := a.db.ClearLoginThrottle(r.Context(), accountLoginKey(user.Email))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't reset login attempts: %s", err))
+		return
+	}
+
+	token_signed, err := a.tokens.Create(user.Id, user.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
+		return
+	}
+
+	refresh_token_string, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create refresh token: %s", err))
+		return
+	}
+	_, err = a.db.CreateRefreshToken(r.Context(), user.Id, token.Hash(refresh_token_string), time.Now().Add(refresh_token_expiry).UTC(), clientUserAgent(r), clientIP(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create refresh token: %s", err))
+		return
+	}
+
+	user_without_password := struct {
+		Id           int           `json:"id"`
+		Email        string        `json:"email"`
+		IsChirpyRed  bool          `json:"is_chirpy_red"`
+		Role         database.Role `json:"role"`
+		Token        string        `json:"token"`
+		RefreshToken string        `json:"refresh_token"`
+	}{
+		Id:           user.Id,
+		Email:        user.Email,
+		IsChirpyRed:  user.IsChirpyRed,
+		Role:         user.Role,
+		Token:        token_signed,
+		RefreshToken: refresh_token_string,
+	}
+
+	respondWithJSON(w, http.StatusOK, user_without_password)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+// loginPolicy decides how long a key is locked out after failed logins
+type loginPolicy struct {
+	// threshold is how many failures are allowed before any delay
+	threshold int
+	// baseDelay doubles with every failure past the threshold
+	baseDelay time.Duration
+	// maxDelay caps the delay, which is the longest lockout
+	maxDelay time.Duration
+}
+
+// loginFailureWindow is how long a failure counts against a key
+const loginFailureWindow = time.Hour
+
+var (
+	accountLoginPolicy = loginPolicy{threshold: 5, baseDelay: time.Second, maxDelay: 15 * time.Minute}
+	ipLoginPolicy      = loginPolicy{threshold: 20, baseDelay: time.Second, maxDelay: 15 * time.Minute}
+)
+
+// lockedUntil returns when a key may next try to log in
+func (p loginPolicy) lockedUntil(throttle database.LoginThrottle) time.Time {
+	if throttle.Failures < p.threshold {
+		return time.Time{}
+	}
+
+	exponent := float64(throttle.Failures - p.threshold)
+	delay := time.Duration(math.Min(float64(p.baseDelay)*math.Pow(2, exponent), float64(p.maxDelay)))
+
+	return throttle.LastFailureAt.Add(delay)
+}
+
+// accountLoginKey and ipLoginKey name the throttles of a login attempt.
+// Accounts are keyed by email so unknown emails are throttled the same way.
+func accountLoginKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// reserveLoginAttempt counts an attempt to log in as email against both
+// the account and the client's IP before the attempt is checked, so that
+// concurrent guesses are counted too. It returns how long the client must
+// wait first if either is locked out, in which case nothing is counted.
+// Attempts that succeed must be handed to releaseLoginAttempt.
+func (a *apiConfig) reserveLoginAttempt(r *http.Request, email string) (time.Duration, error) {
+	now := time.Now().UTC()
+
+	locked_until, err := a.db.ReserveLoginAttempt(r.Context(), map[string]database.LoginLimit{
+		accountLoginKey(email):  accountLoginPolicy.lockedUntil,
+		ipLoginKey(clientIP(r)): ipLoginPolicy.lockedUntil,
+	}, now, now.Add(-loginFailureWindow))
+	if err != nil {
+		return 0, err
+	}
+
+	return locked_until.Sub(now), nil
+}
+
+// releaseLoginAttempt takes back an attempt reserved by
+// reserveLoginAttempt once it turned out to be correct
+func (a *apiConfig) releaseLoginAttempt(r *http.Request, email string) error {
+	return a.db.ReleaseLoginAttempt(r.Context(), []string{accountLoginKey(email), ipLoginKey(clientIP(r))})
+}
+
+// recordFailedLogin audits a failed login. The failure already counts
+// against the account and the IP from when the attempt was reserved.
+func (a *apiConfig) recordFailedLogin(r *http.Request, email string, user_id int, reason string) error {
+	return a.db.RecordFailedLogin(r.Context(), database.FailedLogin{
+		Email:     email,
+		UserID:    user_id,
+		IP:        clientIP(r),
+		UserAgent: clientUserAgent(r),
+		Reason:    reason,
+		At:        time.Now().UTC(),
+	})
+}
+
+// respondWithLoginThrottled rejects a login attempt made during a lockout
+func respondWithLoginThrottled(w http.ResponseWriter, retry_after time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry_after.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
+
+// handlerAdminFailedLoginsGet lists the most recent failed logins
+func (a *apiConfig) handlerAdminFailedLoginsGet(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if limit_string := r.URL.Query().Get("limit"); limit_string != "" {
+		parsed, err := strconv.Atoi(limit_string)
+		if err != nil || parsed < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	failed_logins, err := a.db.GetFailedLogins(r.Context(), limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get failed logins: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, failed_logins)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/secretbox"
+	"github.com/Hien-Trinh/chirpy/internal/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountFailures returns how many failed logins count against email
+func (api *testAPI) accountFailures(email string) int {
+	api.t.Helper()
+
+	key := accountLoginKey(email)
+	throttles, err := api.cfg.db.GetLoginThrottles(context.Background(), key)
+	if err != nil {
+		api.t.Fatalf("GetLoginThrottles: %v", err)
+	}
+	return throttles[key].Failures
+}
+
+func TestLoginClearsThrottle(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+
+	res := api.do(http.MethodPost, "/api/login", "", map[string]string{
+		"email":    "user@example.com",
+		"password": "wrong password",
+	}, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", res.StatusCode)
+	}
+	if failures := api.accountFailures("user@example.com"); failures != 1 {
+		t.Fatalf("%d failures recorded, want 1", failures)
+	}
+
+	api.login("user@example.com", testPassword)
+	if failures := api.accountFailures("user@example.com"); failures != 0 {
+		t.Fatalf("%d failures left after logging in, want 0", failures)
+	}
+}
+
+func TestLoginThrottlesConcurrentGuesses(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+
+	const attempts = 20
+	statuses := make([]int, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := api.do(http.MethodPost, "/api/login", "", map[string]string{
+				"email":    "user@example.com",
+				"password": "wrong password",
+			}, nil)
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	// Every guess is counted before it is checked, so no more than the
+	// threshold of guesses reach the password comparison
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusUnauthorized] != accountLoginPolicy.threshold {
+		t.Fatalf("%d guesses were checked, want %d", counts[http.StatusUnauthorized], accountLoginPolicy.threshold)
+	}
+	if counts[http.StatusTooManyRequests] != attempts-accountLoginPolicy.threshold {
+		t.Fatalf("statuses = %v, want the rest throttled", counts)
+	}
+}
+
+func TestLoginUpgradesBcryptHash(t *testing.T) {
+	api := newTestAPI(t)
+	user := api.createUser("walt@example.com")
+
+	bcrypt_hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+	_, err = api.cfg.db.UpdateUserPassword(context.Background(), user.Id, string(bcrypt_hash))
+	if err != nil {
+		t.Fatalf("UpdateUserPassword: %v", err)
+	}
+
+	res := api.do(http.MethodPost, "/api/login", "", map[string]string{
+		"email":    user.Email,
+		"password": "wrong horse",
+	}, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password against bcrypt hash: status %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	stored, err := api.cfg.db.GetUserById(context.Background(), user.Id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if stored.Password != string(bcrypt_hash) {
+		t.Fatal("a failed login changed the stored hash")
+	}
+
+	api.login(user.Email, testPassword)
+
+	stored, err = api.cfg.db.GetUserById(context.Background(), user.Id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Fatalf("stored hash after login = %q, want it upgraded to Argon2id", stored.Password)
+	}
+	if api.cfg.passwordHasher.NeedsRehash(stored.Password) {
+		t.Error("upgraded hash still needs a rehash")
+	}
+
+	// The upgraded hash still logs in
+	api.login(user.Email, testPassword)
+}
+
+func TestLoginKeepsThrottleUntilSecondFactor(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	sealed, err := secretbox.Seal(api.cfg.totpKey, secret)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	_, err = api.cfg.db.SetUserTOTPSecret(ctx, user.Id, sealed)
+	if err != nil {
+		t.Fatalf("SetUserTOTPSecret: %v", err)
+	}
+	_, err = api.cfg.db.EnableUserTOTP(ctx, user.Id, 0, nil)
+	if err != nil {
+		t.Fatalf("EnableUserTOTP: %v", err)
+	}
+
+	// Guess second factors, each time after a correct password
+	for i := 0; i < 3; i++ {
+		login := api.login("user@example.com", testPassword)
+		if !login.TwoFactorRequired {
+			t.Fatal("login didn't ask for a second factor")
+		}
+		res := api.do(http.MethodPost, "/api/login/2fa", "", map[string]string{
+			"challenge_token": login.ChallengeToken,
+			"code":            "000000",
+		}, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong code: status %d", res.StatusCode)
+		}
+	}
+	if failures := api.accountFailures("user@example.com"); failures != 3 {
+		t.Fatalf("%d failures recorded, want 3", failures)
+	}
+
+	login := api.login("user@example.com", testPassword)
+	if failures := api.accountFailures("user@example.com"); failures != 3 {
+		t.Fatalf("the password alone reset the failures to %d", failures)
+	}
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	session := loginResponse{}
+	res := api.do(http.MethodPost, "/api/login/2fa", "", map[string]string{
+		"challenge_token": login.ChallengeToken,
+		"code":            code,
+	}, &session)
+	if res.StatusCode != http.StatusOK || session.Token == "" {
+		t.Fatalf("correct code: status %d", res.StatusCode)
+	}
+	if failures := api.accountFailures("user@example.com"); failures != 0 {
+		t.Fatalf("%d failures left after the second factor, want 0", failures)
+	}
+}
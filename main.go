@@ -1,76 +1,465 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/Hien-Trinh/chirpy/internal/auth"
 	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/mailer"
+	"github.com/Hien-Trinh/chirpy/internal/metrics"
+	"github.com/Hien-Trinh/chirpy/internal/oidc"
+	"github.com/Hien-Trinh/chirpy/internal/password"
+	"github.com/Hien-Trinh/chirpy/internal/secretbox"
+	"github.com/Hien-Trinh/chirpy/internal/tracing"
+	"github.com/Hien-Trinh/chirpy/internal/webhooks"
 	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	db             *database.DB
-	jwtSecret      string
-	polkaApiKey    string
+	logger      *slog.Logger
+	metrics     *serverMetrics
+	db          *database.DB
+	jwtKeys     *auth.KeySet
+	tokens      *auth.TokenService
+	polkaApiKey string
+	// polkaWebhookSecret signs every webhook; without it webhooks are rejected
+	polkaWebhookSecret    []byte
+	polkaWebhookTolerance time.Duration
+	mailer                mailer.Mailer
+	totpKey               []byte
+	oidcProviders         map[string]*oidc.Provider
+	passwordPolicy        password.Policy
+	passwordHasher        *password.Hasher
+	// dummyPasswordHash is verified against when a login names an unknown
+	// email, so the response takes as long as for a wrong password
+	dummyPasswordHash string
+	webhooks          *webhooks.Dispatcher
+	// metricsToken, when set, is required to scrape /metrics
+	metricsToken string
 }
 
 func main() {
-	const filepathRoot = "."
+	// Only this directory is served under /app, never the working directory
+	const filepathRoot = "static"
 	const port = "8080"
 
+	dbg := flag.Bool("debug", false, "Enable debug mode")
+	promoteAdmin := flag.String("promote-admin", "", "Promote the user with this email to admin and exit")
+	flag.Parse()
+
+	// ctx is canceled by SIGINT or SIGTERM, which starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	registry := metrics.NewRegistry()
 	apiCfg := apiConfig{
-		fileserverHits: 0,
+		metrics: newServerMetrics(registry),
 	}
 	db, err := database.NewDB("database.json")
 	if err != nil {
 		log.Fatalf("Error opening database: %s", err)
 	}
 
+	if *dbg {
+		err = db.ResetDB(ctx)
+		if err != nil {
+			log.Fatalf("Error resetting database: %s", err)
+		}
+	}
+
+	if *promoteAdmin != "" {
+		user, err := db.GetUserByEmail(ctx, *promoteAdmin)
+		if err != nil {
+			log.Fatalf("Error finding user: %s", err)
+		}
+		_, err = db.UpdateUserRole(ctx, user.Id, database.RoleAdmin)
+		if err != nil {
+			log.Fatalf("Error promoting user: %s", err)
+		}
+		log.Printf("Promoted %s to admin", user.Email)
+		return
+	}
+
+	db.Instrument(registry)
 	apiCfg.db = db
 
 	err = godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
-	apiCfg.jwtSecret = os.Getenv("JWT_SECRET")
+
+	apiCfg.logger, err = newLogger()
+	if err != nil {
+		log.Fatalf("Error configuring logging: %s", err)
+	}
+	// log.Printf goes through the same handler
+	slog.SetDefault(apiCfg.logger)
+
+	exporter, err := tracing.NewExporter(ctx)
+	if err != nil {
+		log.Fatalf("Error configuring tracing: %s", err)
+	}
+	shutdownTracing, err := tracing.Setup(ctx, exporter, "chirpy")
+	if err != nil {
+		log.Fatalf("Error configuring tracing: %s", err)
+	}
+	apiCfg.jwtKeys, err = auth.NewKeySet(auth.KeySetConfig{
+		Dir:          os.Getenv("JWT_KEYS_DIR"),
+		SigningKeyId: os.Getenv("JWT_SIGNING_KEY_ID"),
+		HMACSecret:   os.Getenv("JWT_SECRET"),
+	})
+	if err != nil {
+		log.Fatalf("Error loading JWT keys: %s", err)
+	}
+	apiCfg.tokens = auth.NewTokenService(apiCfg.jwtKeys, auth.TokenConfig{
+		Issuer:   envOrDefault("JWT_ISSUER", "chirpy"),
+		Audience: envOrDefault("JWT_AUDIENCE", "chirpy"),
+		TTL:      envDuration("JWT_TTL", time.Hour),
+		Leeway:   envDuration("JWT_LEEWAY", 30*time.Second),
+	})
+	apiCfg.metricsToken = os.Getenv("METRICS_TOKEN")
 	apiCfg.polkaApiKey = os.Getenv("POLKA_API_KEY")
+	apiCfg.polkaWebhookSecret = []byte(os.Getenv("POLKA_WEBHOOK_SECRET"))
+	apiCfg.polkaWebhookTolerance = envDuration("POLKA_WEBHOOK_TOLERANCE", 5*time.Minute)
+	if apiCfg.polkaApiKey != "" && len(apiCfg.polkaWebhookSecret) == 0 {
+		apiCfg.logger.Warn("POLKA_WEBHOOK_SECRET is not set, so Polka webhooks will be rejected")
+	}
+
+	if key := os.Getenv("TOTP_ENCRYPTION_KEY"); key != "" {
+		apiCfg.totpKey, err = secretbox.ParseKey(key)
+		if err != nil {
+			log.Fatalf("Error parsing TOTP_ENCRYPTION_KEY: %s", err)
+		}
+	}
+
+	apiCfg.passwordPolicy, err = newPasswordPolicy()
+	if err != nil {
+		log.Fatalf("Error configuring password policy: %s", err)
+	}
+
+	apiCfg.passwordHasher, err = password.NewHasher(password.Argon2idParams{
+		Memory:      uint32(envUint("ARGON2_MEMORY", uint64(password.DefaultArgon2idParams.Memory), 32)),
+		Iterations:  uint32(envUint("ARGON2_ITERATIONS", uint64(password.DefaultArgon2idParams.Iterations), 32)),
+		Parallelism: uint8(envUint("ARGON2_PARALLELISM", uint64(password.DefaultArgon2idParams.Parallelism), 8)),
+		SaltLength:  password.DefaultArgon2idParams.SaltLength,
+		KeyLength:   password.DefaultArgon2idParams.KeyLength,
+	})
+	if err != nil {
+		log.Fatalf("Error configuring password hashing: %s", err)
+	}
+	apiCfg.dummyPasswordHash, err = apiCfg.passwordHasher.Hash(ctx, "chirpy-dummy-password")
+	if err != nil {
+		log.Fatalf("Error hashing dummy password: %s", err)
+	}
+
+	apiCfg.oidcProviders, err = newOIDCProviders()
+	if err != nil {
+		log.Fatalf("Error configuring identity providers: %s", err)
+	}
+
+	apiCfg.mailer, err = newMailer()
+	if err != nil {
+		log.Fatalf("Error configuring mailer: %s", err)
+	}
+
+	apiCfg.webhooks = webhooks.NewDispatcher(db, webhooks.Config{
+		MaxAttempts:          envInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		BaseDelay:            envDuration("WEBHOOK_RETRY_DELAY", 30*time.Second),
+		AllowPrivateNetworks: os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true",
+	})
+
+	workers := &sync.WaitGroup{}
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		apiCfg.expireSubscriptions(ctx, envDuration("SUBSCRIPTION_EXPIRY_INTERVAL", time.Minute))
+	}()
+	go func() {
+		defer workers.Done()
+		apiCfg.publishScheduledChirps(ctx, envDuration("SCHEDULED_CHIRP_INTERVAL", 30*time.Second))
+	}()
+	go func() {
+		defer workers.Done()
+		apiCfg.webhooks.Run(ctx)
+	}()
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           apiCfg.routes(filepathRoot),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    envInt("SERVER_MAX_HEADER_BYTES", 64<<10),
+	}
+
+	serve_err := make(chan error, 2)
+	go func() {
+		serve_err <- srv.ListenAndServe()
+	}()
+	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
+
+	var metrics_srv *http.Server
+	if metrics_addr := os.Getenv("METRICS_ADDR"); metrics_addr != "" {
+		metrics_srv = &http.Server{
+			Addr:              metrics_addr,
+			Handler:           apiCfg.metricsRoutes(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			serve_err <- metrics_srv.ListenAndServe()
+		}()
+		log.Printf("Serving metrics on %s\n", metrics_addr)
+	} else if apiCfg.metricsToken == "" {
+		apiCfg.logger.Warn("Neither METRICS_ADDR nor METRICS_TOKEN is set, so /metrics is not served")
+	}
+
+	select {
+	case err = <-serve_err:
+		log.Printf("Error serving: %s", err)
+	case <-ctx.Done():
+		err = nil
+	}
+	// Stops the workers if serving failed, and lets a second signal kill
+	// the process if the shutdown hangs
+	stop()
+
+	// Scrapes are cheap and can simply be cut off
+	if metrics_srv != nil {
+		metrics_srv.Close()
+	}
+
+	ok := shutdown(srv, workers, db, shutdownTracing, envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	if err != nil || !ok {
+		os.Exit(1)
+	}
+}
 
+// routes returns the handler for every route, wrapped in the middleware
+// that traces, logs and measures each request
+func (a *apiConfig) routes(filepathRoot string) http.Handler {
 	mux := http.NewServeMux()
-	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
-	mux.Handle("/app/*", fsHandler)
+	fsHandler := a.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
+	mux.Handle("/app/", fsHandler)
 
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /api/reset", apiCfg.handlerReset)
+	mux.HandleFunc("GET /metrics", a.handlerPrometheusMetrics)
+	mux.HandleFunc("GET /.well-known/jwks.json", a.handlerJWKS)
+	mux.HandleFunc("GET /api/reset", a.middlewareRequireRole(database.RoleAdmin, a.handlerReset))
 
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
+	mux.HandleFunc("GET /admin/metrics", a.middlewareRequireRole(database.RoleAdmin, a.handlerMetrics))
 	mux.HandleFunc("GET /admin/metrics/", func(w http.ResponseWriter, r *http.Request) {
 		// Redirect to /admin/metrics if slash is present
 		http.Redirect(w, r, "/admin/metrics", http.StatusMovedPermanently)
 	})
+	mux.HandleFunc("PUT /admin/users/{id}/role", a.middlewareRequireRole(database.RoleAdmin, a.handlerAdminUsersRolePut))
+	mux.HandleFunc("GET /admin/webhooks/polka", a.middlewareRequireRole(database.RoleAdmin, a.handlerAdminPolkaWebhooksGet))
+	mux.HandleFunc("GET /admin/failed-logins", a.middlewareRequireRole(database.RoleAdmin, a.handlerAdminFailedLoginsGet))
 
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirpsPost)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerChirpsGet)
-	mux.HandleFunc("GET /api/chirps/{id}", apiCfg.handlerChirpsGetById)
-	mux.HandleFunc("DELETE /api/chirps/{id}", apiCfg.handlerChirpsDeleteById)
+	mux.HandleFunc("POST /api/chirps", a.middlewareAuth(a.handlerChirpsPost, database.ScopeChirpsWrite))
+	mux.HandleFunc("GET /api/chirps", a.middlewareOptionalAuth(a.handlerChirpsGet, database.ScopeChirpsRead))
+	mux.HandleFunc("GET /api/chirps/{id}", a.middlewareOptionalAuth(a.handlerChirpsGetById, database.ScopeChirpsRead))
+	mux.HandleFunc("PUT /api/chirps/{id}", a.middlewareAuth(a.handlerChirpsPutById, database.ScopeChirpsWrite))
+	mux.HandleFunc("DELETE /api/chirps/{id}", a.middlewareAuth(a.handlerChirpsDeleteById, database.ScopeChirpsWrite))
 
-	mux.HandleFunc("POST /api/users", apiCfg.handlerUsersPost)
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUsersPut)
+	mux.HandleFunc("POST /api/users", a.handlerUsersPost)
+	mux.HandleFunc("PUT /api/users/me/email", a.middlewareAuth(a.handlerUsersMeEmailPut))
+	mux.HandleFunc("PUT /api/users/me/password", a.middlewareAuth(a.handlerUsersMePasswordPut))
+	mux.HandleFunc("PATCH /api/users/me", a.middlewareAuth(a.handlerUsersMePatch, database.ScopeProfileWrite))
+	mux.HandleFunc("DELETE /api/users/me", a.middlewareAuth(a.handlerUsersMeDelete))
+	mux.HandleFunc("GET /api/users/me/subscription", a.middlewareAuth(a.handlerUsersMeSubscriptionGet))
+	mux.HandleFunc("GET /api/users/me/export", a.middlewareAuth(a.handlerUsersMeExportGet))
+	mux.HandleFunc("GET /api/users/{id}", a.handlerUsersGetById)
+	mux.HandleFunc("GET /api/users/by-handle/{handle}", a.handlerUsersGetByHandle)
 
-	mux.HandleFunc("POST /api/login", apiCfg.handlerLoginPost)
+	mux.HandleFunc("POST /api/users/me/verify-email", a.middlewareAuth(a.handlerVerifyEmailRequestPost))
+	mux.HandleFunc("POST /api/verify-email", a.handlerVerifyEmailConfirmPost)
+	mux.HandleFunc("POST /api/password-reset", a.handlerPasswordResetRequestPost)
+	mux.HandleFunc("POST /api/password-reset/confirm", a.handlerPasswordResetConfirmPost)
 
-	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshPost)
+	mux.HandleFunc("POST /api/login", a.handlerLoginPost)
+	mux.HandleFunc("POST /api/login/2fa", a.handlerLoginTwoFactorPost)
+	mux.HandleFunc("GET /api/auth/oidc/{provider}/login", a.handlerOIDCLoginGet)
+	mux.HandleFunc("GET /api/auth/oidc/{provider}/callback", a.handlerOIDCCallbackGet)
 
-	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevokePost)
+	mux.HandleFunc("POST /api/users/me/2fa/totp", a.middlewareAuth(a.handlerTOTPEnrollPost))
+	mux.HandleFunc("POST /api/users/me/2fa/totp/confirm", a.middlewareAuth(a.handlerTOTPConfirmPost))
+	mux.HandleFunc("DELETE /api/users/me/2fa/totp", a.middlewareAuth(a.handlerTOTPDelete))
 
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerChirpyRedPost)
+	mux.HandleFunc("POST /api/refresh", a.handlerRefreshPost)
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+	mux.HandleFunc("POST /api/revoke", a.handlerRevokePost)
+
+	mux.HandleFunc("GET /api/sessions", a.middlewareAuth(a.handlerSessionsGet))
+	mux.HandleFunc("DELETE /api/sessions", a.middlewareAuth(a.handlerSessionsDelete))
+	mux.HandleFunc("DELETE /api/sessions/{id}", a.middlewareAuth(a.handlerSessionsDeleteById))
+
+	mux.HandleFunc("POST /api/webhooks", a.middlewareAuth(a.handlerWebhooksPost))
+	mux.HandleFunc("GET /api/webhooks", a.middlewareAuth(a.handlerWebhooksGet))
+	mux.HandleFunc("DELETE /api/webhooks/{id}", a.middlewareAuth(a.handlerWebhooksDeleteById))
+	mux.HandleFunc("GET /api/webhooks/{id}/deliveries", a.middlewareAuth(a.handlerWebhookDeliveriesGet))
+	mux.HandleFunc("POST /api/webhooks/{id}/deliveries/{delivery_id}/retry", a.middlewareAuth(a.handlerWebhookDeliveryRetryPost))
+
+	mux.HandleFunc("POST /api/tokens", a.middlewareAuth(a.handlerTokensPost))
+	mux.HandleFunc("GET /api/tokens", a.middlewareAuth(a.handlerTokensGet))
+	mux.HandleFunc("DELETE /api/tokens/{id}", a.middlewareAuth(a.handlerTokensDeleteById))
+
+	mux.HandleFunc("POST /api/polka/webhooks", a.handlerChirpyRedPost)
+
+	return a.middlewareTrace(mux, a.middlewareLog(mux, a.middlewareInstrument(mux)))
+}
+
+// tracingFlushTimeout bounds how long shutdown waits for the last spans
+// to be exported
+const tracingFlushTimeout = 5 * time.Second
+
+// shutdown stops taking requests and waits up to drain for the ones in
+// flight and the background workers, then closes the database if they
+// all stopped, and flushes traces. It reports whether everything stopped
+// cleanly.
+func shutdown(srv *http.Server, workers *sync.WaitGroup, db *database.DB, shutdownTracing func(context.Context) error, drain time.Duration) bool {
+	log.Printf("Shutting down, waiting up to %s for requests to finish", drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	ok := true
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error draining requests: %s", err)
+		ok = false
 	}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(srv.ListenAndServe())
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("Background workers didn't stop in time")
+		ok = false
+	}
+
+	// Requests or workers still running would fail halfway through their
+	// changes, so the database is only closed once they all stopped
+	if ok {
+		err = db.Close()
+		if err != nil {
+			log.Printf("Error closing database: %s", err)
+			ok = false
+		}
+	} else {
+		log.Printf("Leaving the database open for the requests still running")
+	}
+
+	// The drain may have used up ctx, and the spans of a slow shutdown
+	// are the ones most worth flushing
+	trace_ctx, trace_cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	defer trace_cancel()
+	err = shutdownTracing(trace_ctx)
+	if err != nil {
+		log.Printf("Error flushing traces: %s", err)
+		ok = false
+	}
+
+	log.Printf("Shut down")
+	return ok
+}
+
+// newMailer configures the mailer from the environment.
+// MAILER=smtp sends real email; anything else writes messages to MAIL_LOG_PATH or stdout.
+func newMailer() (mailer.Mailer, error) {
+	if os.Getenv("MAILER") == "smtp" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &mailer.SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}, nil
+	}
+
+	path := os.Getenv("MAIL_LOG_PATH")
+	if path == "" {
+		return mailer.NewLogMailer(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return mailer.NewLogMailer(file), nil
+}
+
+// envOrDefault returns the value of an environment variable, or def if it is unset
+func envOrDefault(name, def string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	return value
+}
+
+// envDuration parses an environment variable as a duration such as "15m",
+// or returns def if it is unset
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %s", name, err)
+	}
+
+	return d
+}
+
+// envInt parses an environment variable as an integer, or returns def if it is unset
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %s", name, err)
+	}
+
+	return i
+}
+
+// envUint parses an environment variable as an unsigned integer that
+// fits in bits bits, or returns def if it is unset
+func envUint(name string, def uint64, bits int) uint64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	u, err := strconv.ParseUint(value, 10, bits)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %s", name, err)
+	}
+
+	return u
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/mailer"
+	"github.com/Hien-Trinh/chirpy/internal/metrics"
+	"github.com/Hien-Trinh/chirpy/internal/oidc"
+	"github.com/Hien-Trinh/chirpy/internal/password"
+	"github.com/Hien-Trinh/chirpy/internal/webhooks"
+)
+
+// testPassword satisfies the default password policy
+const testPassword = "correct horse"
+
+// testAPI is a Chirpy server with a database of its own
+type testAPI struct {
+	t       *testing.T
+	cfg     *apiConfig
+	handler http.Handler
+	// cookies are kept between requests by name, like a browser would
+	cookies map[string]*http.Cookie
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+
+	keys, err := auth.NewKeySet(auth.KeySetConfig{HMACSecret: "test-secret"})
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+
+	cfg := &apiConfig{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newServerMetrics(metrics.NewRegistry()),
+		db:      db,
+		jwtKeys: keys,
+		tokens: auth.NewTokenService(keys, auth.TokenConfig{
+			Issuer:   "chirpy",
+			Audience: "chirpy",
+			TTL:      time.Hour,
+		}),
+		polkaApiKey:           "polka-key",
+		polkaWebhookSecret:    []byte("polka-secret"),
+		polkaWebhookTolerance: 5 * time.Minute,
+		mailer:                mailer.NewLogMailer(io.Discard),
+		totpKey:               bytes.Repeat([]byte{1}, 32),
+		oidcProviders:         map[string]*oidc.Provider{},
+		passwordPolicy:        password.DefaultPolicy,
+	}
+	// Cheap parameters keep the tests fast
+	cfg.passwordHasher, err = password.NewHasher(password.Argon2idParams{
+		Memory:      1024,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	})
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+	cfg.dummyPasswordHash, err = cfg.passwordHasher.Hash(context.Background(), "chirpy-dummy-password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	cfg.webhooks = webhooks.NewDispatcher(db, webhooks.Config{})
+
+	return &testAPI{
+		t:       t,
+		cfg:     cfg,
+		handler: cfg.routes(t.TempDir()),
+		cookies: map[string]*http.Cookie{},
+	}
+}
+
+// do sends a request with a JSON body, authenticated with token unless it is
+// empty, and decodes the JSON response into out unless it is nil
+func (api *testAPI) do(method, path, token string, body, out interface{}) *http.Response {
+	api.t.Helper()
+
+	payload := &bytes.Buffer{}
+	if body != nil {
+		err := json.NewEncoder(payload).Encode(body)
+		if err != nil {
+			api.t.Fatalf("encoding request: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, payload)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for _, cookie := range api.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	api.handler.ServeHTTP(rec, req)
+
+	res := rec.Result()
+	for _, cookie := range res.Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(api.cookies, cookie.Name)
+		} else {
+			api.cookies[cookie.Name] = cookie
+		}
+	}
+	if out != nil && res.StatusCode < 300 {
+		err := json.NewDecoder(res.Body).Decode(out)
+		if err != nil {
+			api.t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return res
+}
+
+// createUser signs up a user through the API
+func (api *testAPI) createUser(email string) database.User {
+	api.t.Helper()
+
+	res := api.do(http.MethodPost, "/api/users", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	}, nil)
+	if res.StatusCode != http.StatusCreated {
+		api.t.Fatalf("creating %s: status %d", email, res.StatusCode)
+	}
+
+	user, err := api.cfg.db.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		api.t.Fatalf("GetUserByEmail: %v", err)
+	}
+	return user
+}
+
+// loginResponse is the body of a successful login
+type loginResponse struct {
+	Id                int    `json:"id"`
+	Email             string `json:"email"`
+	IsChirpyRed       bool   `json:"is_chirpy_red"`
+	Token             string `json:"token"`
+	RefreshToken      string `json:"refresh_token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+// login logs in through the API, failing the test unless it succeeds
+func (api *testAPI) login(email, pass string) loginResponse {
+	api.t.Helper()
+
+	login := loginResponse{}
+	res := api.do(http.MethodPost, "/api/login", "", map[string]string{
+		"email":    email,
+		"password": pass,
+	}, &login)
+	if res.StatusCode != http.StatusOK {
+		api.t.Fatalf("logging in as %s: status %d", email, res.StatusCode)
+	}
+	return login
+}
+
+func TestAppServesOnlyStaticDir(t *testing.T) {
+	api := newTestAPI(t)
+	handler := api.cfg.routes("static")
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/app/", http.StatusOK},
+		{"/app/assets/logo.png", http.StatusOK},
+		{"/app/database.json", http.StatusNotFound},
+		{"/app/main.go", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+}
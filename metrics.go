@@ -1,11 +1,68 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"html"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/metrics"
 )
 
+// serverMetrics are the metrics the HTTP server records
+type serverMetrics struct {
+	registry        *metrics.Registry
+	fileserverHits  *metrics.Counter
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+}
+
+func newServerMetrics(registry *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		registry: registry,
+		fileserverHits: registry.NewCounter(
+			"chirpy_fileserver_hits_total",
+			"Requests for files under /app.",
+		),
+		requests: registry.NewCounterVec(
+			"chirpy_http_requests_total",
+			"HTTP requests by method, route pattern and status code.",
+			"method", "route", "status",
+		),
+		requestDuration: registry.NewHistogramVec(
+			"chirpy_http_request_duration_seconds",
+			"Time taken to handle HTTP requests by method and route pattern.",
+			metrics.DefaultBuckets,
+			"method", "route",
+		),
+	}
+}
+
+// handlerMetrics renders the admin dashboard
 func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	type routeCount struct {
+		route    string
+		requests uint64
+	}
+	counts := map[string]uint64{}
+	cfg.metrics.requests.Each(func(values []string, counter *metrics.Counter) {
+		counts[values[0]+" "+values[1]] += counter.Value()
+	})
+	routes := make([]routeCount, 0, len(counts))
+	for route, requests := range counts {
+		routes = append(routes, routeCount{route: route, requests: requests})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].route < routes[j].route })
+
+	rows := strings.Builder{}
+	for _, route := range routes {
+		rows.WriteString(fmt.Sprintf("\t\t\t<tr><td>%s</td><td>%d</td></tr>\n", html.EscapeString(route.route), route.requests))
+	}
+
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf(`
@@ -14,15 +71,123 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
 	<body>
 		<h1>Welcome, Chirpy Admin</h1>
 		<p>Chirpy has been visited %d times!</p>
+		<table>
+			<tr><th>Route</th><th>Requests</th></tr>
+%s		</table>
 	</body>
 
 	</html>
-		`, cfg.fileserverHits)))
+		`, cfg.metrics.fileserverHits.Value(), rows.String())))
+}
+
+// handlerPrometheusMetrics serves every metric in the Prometheus text format
+// to scrapers that send METRICS_TOKEN as a Bearer token. Without a token
+// metrics are only served on METRICS_ADDR, see metricsRoutes.
+func (cfg *apiConfig) handlerPrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	if cfg.metricsToken == "" {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.metricsToken)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid metrics token")
+		return
+	}
+
+	cfg.metrics.registry.Handler().ServeHTTP(w, r)
+}
+
+// metricsRoutes returns the handler for a listener of its own that serves
+// only /metrics, without a token. It should be reachable from the scraper
+// but not the internet.
+func (cfg *apiConfig) metricsRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", cfg.metrics.registry.Handler())
+	return mux
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+		cfg.metrics.fileserverHits.Inc()
 		next.ServeHTTP(w, r)
 	})
 }
+
+// middlewareInstrument counts and times every request by the mux pattern
+// that handles it, so /api/chirps/1 and /api/chirps/2 share a route
+func (cfg *apiConfig) middlewareInstrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		route := routePattern(mux, r)
+		method := metricsMethod(r.Method)
+
+		recorder := newStatusRecorder(w)
+		mux.ServeHTTP(recorder, r)
+
+		cfg.metrics.requests.With(method, route, strconv.Itoa(recorder.status)).Inc()
+		cfg.metrics.requestDuration.With(method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routePattern returns the path of the mux pattern that handles r,
+// or "unmatched"
+func routePattern(mux *http.ServeMux, r *http.Request) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+
+	// Patterns may start with a method, which is logged on its own
+	if i := strings.Index(pattern, " "); i >= 0 {
+		pattern = pattern[i+1:]
+	}
+	return pattern
+}
+
+// metricsMethod keeps clients from creating a label per made-up method
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// statusRecorder remembers the status code a handler responded with
+// and how many bytes of body it wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	if recorder, ok := w.(*statusRecorder); ok {
+		return recorder
+	}
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Hien-Trinh/chirpy/internal/metrics"
+)
+
+func TestPrometheusMetricsGated(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		sent  string
+		want  int
+	}{
+		{"no token configured", "", "", http.StatusNotFound},
+		{"no token configured, one sent", "", "anything", http.StatusNotFound},
+		{"token missing", "scrape-secret", "", http.StatusUnauthorized},
+		{"token wrong", "scrape-secret", "scrape-secre", http.StatusUnauthorized},
+		{"token right", "scrape-secret", "scrape-secret", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			api.cfg.metricsToken = tc.token
+
+			res := api.do(http.MethodGet, "/metrics", tc.sent, nil, nil)
+			if res.StatusCode != tc.want {
+				t.Fatalf("GET /metrics: status %d, want %d", res.StatusCode, tc.want)
+			}
+			if tc.want == http.StatusOK && res.Header.Get("Content-Type") != metrics.ContentType {
+				t.Fatalf("Content-Type = %q, want %q", res.Header.Get("Content-Type"), metrics.ContentType)
+			}
+		})
+	}
+}
+
+func TestMetricsListenerServesOnlyMetrics(t *testing.T) {
+	api := newTestAPI(t)
+	handler := api.cfg.metricsRoutes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE chirpy_http_requests_total counter") {
+		t.Fatalf("GET /metrics: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("GET /api/healthz on the metrics listener: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
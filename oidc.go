@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/oidc"
+	"github.com/Hien-Trinh/chirpy/internal/token"
+)
+
+const (
+	// oidcLoginExpiry is how long the user has to sign in at the provider
+	oidcLoginExpiry = 10 * time.Minute
+
+	// oidcStateCookie ties a login to the browser that started it, so an
+	// attacker can't finish their own login in someone else's browser
+	oidcStateCookie = "chirpy_oidc_state"
+)
+
+// handlerOIDCLoginGet starts signing in with an external identity provider
+// by redirecting to it
+func (a *apiConfig) handlerOIDCLoginGet(w http.ResponseWriter, r *http.Request) {
+	provider, ok := a.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	state, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create state: %s", err))
+		return
+	}
+	nonce, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create nonce: %s", err))
+		return
+	}
+	code_verifier, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create code verifier: %s", err))
+		return
+	}
+
+	auth_url, err := provider.AuthCodeURL(r.Context(), state, nonce, code_verifier)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Couldn't reach identity provider: %s", err))
+		return
+	}
+
+	_, err = a.db.CreateOIDCLoginState(r.Context(), provider.Name(), token.Hash(state), nonce, code_verifier, time.Now().Add(oidcLoginExpiry).UTC())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't save login: %s", err))
+		return
+	}
+
+	http.SetCookie(w, oidcStateCookieFor(provider, token.Hash(state), int(oidcLoginExpiry.Seconds())))
+	http.Redirect(w, r, auth_url, http.StatusFound)
+}
+
+// handlerOIDCCallbackGet finishes signing in with an external identity provider.
+// The identity is linked to an existing user by verified email, or a new user is created.
+func (a *apiConfig) handlerOIDCCallbackGet(w http.ResponseWriter, r *http.Request) {
+	provider, ok := a.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	query := r.URL.Query()
+	if provider_error := query.Get("error"); provider_error != "" {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Identity provider returned an error: %s", provider_error))
+		return
+	}
+	if query.Get("state") == "" || query.Get("code") == "" {
+		respondWithError(w, http.StatusBadRequest, "State and code are required")
+		return
+	}
+
+	// Check the state belongs to this browser before using it up, so a
+	// forged callback can't spend the state of a login in progress
+	state_hash := token.Hash(query.Get("state"))
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state_hash)) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid state: login wasn't started in this browser")
+		return
+	}
+	http.SetCookie(w, oidcStateCookieFor(provider, "", -1))
+
+	login_state, err := a.db.ConsumeOIDCLoginState(r.Context(), provider.Name(), state_hash)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid state: %s", err))
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), login_state.CodeVerifier, login_state.Nonce)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Couldn't sign in with identity provider: %s", err))
+		return
+	}
+
+	user, err := a.userForIdentity(r.Context(), provider.Name(), claims)
+	if errors.Is(err, errEmailNotVerified) {
+		respondWithError(w, http.StatusConflict, "An account with this email already exists and the identity provider hasn't verified the email")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't link identity: %s", err))
+		return
+	}
+
+	a.respondWithLogin(w, r, user)
+}
+
+// oidcStateCookieFor returns the cookie holding the state hash of a login
+// with provider, kept for max_age seconds or cleared when it is negative
+func oidcStateCookieFor(provider *oidc.Provider, state_hash string, max_age int) *http.Cookie {
+	return &http.Cookie{
+		Name:  oidcStateCookie,
+		Value: state_hash,
+		// Only the callback needs it
+		Path:     "/api/auth/oidc/" + provider.Name() + "/",
+		MaxAge:   max_age,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.RedirectURL(), "https://"),
+		// Lax still sends it on the provider's top-level redirect back
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+var errEmailNotVerified = errors.New("email not verified by identity provider")
+
+// userForIdentity returns the user linked to the subject of claims,
+// linking or creating one on first sign in
+func (a *apiConfig) userForIdentity(ctx context.Context, provider string, claims *oidc.Claims) (database.User, error) {
+	identity, err := a.db.GetIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		return a.db.GetUserById(ctx, identity.UserID)
+	}
+
+	if claims.Email == "" {
+		return database.User{}, errors.New("identity provider didn't return an email")
+	}
+
+	user, err := a.db.GetUserByEmail(ctx, claims.Email)
+	if err == nil {
+		// Only the provider vouching for the email proves it is the same person
+		if !claims.EmailVerified {
+			return database.User{}, errEmailNotVerified
+		}
+
+		if !user.EmailVerified {
+			// Whoever signed up with this email never proved they own it,
+			// so their password and sessions must not survive the link
+			_, err = a.db.ChangeUserPassword(ctx, user.Id, "")
+			if err != nil {
+				return database.User{}, err
+			}
+		}
+	} else {
+		user, err = a.db.CreateUser(ctx, claims.Email, "", "")
+		if err != nil {
+			return database.User{}, err
+		}
+	}
+
+	if claims.EmailVerified && !user.EmailVerified {
+		user, err = a.db.VerifyUserEmail(ctx, user.Id, user.Email)
+		if err != nil {
+			return database.User{}, err
+		}
+	}
+
+	_, err = a.db.CreateIdentity(ctx, user.Id, provider, claims.Subject, claims.Email)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	return a.db.GetUserById(ctx, user.Id)
+}
+
+// newOIDCProviders configures the identity providers listed in OIDC_PROVIDERS.
+// Each provider NAME reads OIDC_NAME_ISSUER, OIDC_NAME_CLIENT_ID,
+// OIDC_NAME_CLIENT_SECRET, OIDC_NAME_REDIRECT_URL and optionally OIDC_NAME_SCOPES.
+func newOIDCProviders() (map[string]*oidc.Provider, error) {
+	providers := make(map[string]*oidc.Provider)
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+
+		provider, err := oidc.NewProvider(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", name, err)
+		}
+		providers[name] = provider
+	}
+
+	return providers, nil
+}
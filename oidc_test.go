@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/oidc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockClientID     = "chirpy-client"
+	mockClientSecret = "chirpy-secret"
+	mockKeyId        = "mock-key"
+)
+
+// mockAuthorization is a sign in the mock issuer has approved,
+// waiting for its code to be redeemed
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+	claims    oidc.Claims
+}
+
+// mockIssuer is an OpenID Connect provider serving discovery, keys and
+// a token endpoint that checks PKCE, like a real provider would
+type mockIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    ed25519.PrivateKey
+
+	mu             sync.Mutex
+	authorizations map[string]mockAuthorization
+	// nonce replaces the nonce of issued ID tokens when set
+	nonce string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	issuer := &mockIssuer{
+		t:              t,
+		key:            key,
+		authorizations: make(map[string]mockAuthorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("GET /jwks", issuer.handleJWKS)
+	mux.HandleFunc("POST /token", issuer.handleToken)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (m *mockIssuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, oidc.Metadata{
+		Issuer:                m.server.URL,
+		AuthorizationEndpoint: m.server.URL + "/authorize",
+		TokenEndpoint:         m.server.URL + "/token",
+		JWKSURI:               m.server.URL + "/jwks",
+	})
+}
+
+func (m *mockIssuer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": mockKeyId,
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(m.key.Public().(ed25519.PublicKey)),
+		}},
+	})
+}
+
+func (m *mockIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	client_id, client_secret, ok := r.BasicAuth()
+	if !ok || client_id != mockClientID || client_secret != mockClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+
+	m.mu.Lock()
+	authorization, ok := m.authorizations[r.FormValue("code")]
+	delete(m.authorizations, r.FormValue("code"))
+	nonce := m.nonce
+	m.mu.Unlock()
+	if !ok || oidc.CodeChallenge(r.FormValue("code_verifier")) != authorization.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	if nonce == "" {
+		nonce = authorization.nonce
+	}
+	now := time.Now()
+	claims := authorization.claims
+	claims.Nonce = nonce
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    m.server.URL,
+		Audience:  jwt.ClaimStrings{mockClientID},
+		Subject:   authorization.claims.Subject,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+	}
+	id_token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	id_token.Header["kid"] = mockKeyId
+	id_token_signed, err := id_token.SignedString(m.key)
+	if err != nil {
+		m.t.Errorf("signing id token: %v", err)
+		tokenError("server_error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"id_token":     id_token_signed,
+	})
+}
+
+// authorize approves the sign in the user was redirected for,
+// as the user with claims, and returns the authorization code
+func (m *mockIssuer) authorize(auth_url string, claims oidc.Claims) string {
+	m.t.Helper()
+
+	parsed, err := url.Parse(auth_url)
+	if err != nil {
+		m.t.Fatalf("parsing authorization url: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != mockClientID || query.Get("code_challenge_method") != "S256" {
+		m.t.Fatalf("unexpected authorization request %s", auth_url)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(m.authorizations)+1)
+	m.authorizations[code] = mockAuthorization{
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		claims:    claims,
+	}
+	return code
+}
+
+// newOIDCTestAPI returns a test API with the mock issuer configured as "mock"
+func newOIDCTestAPI(t *testing.T) (*testAPI, *mockIssuer) {
+	t.Helper()
+
+	issuer := newMockIssuer(t)
+	api := newTestAPI(t)
+
+	provider, err := oidc.NewProvider(oidc.Config{
+		Name:         "mock",
+		Issuer:       issuer.server.URL,
+		ClientID:     mockClientID,
+		ClientSecret: mockClientSecret,
+		RedirectURL:  "http://chirpy.test/api/auth/oidc/mock/callback",
+		HTTPClient:   issuer.server.Client(),
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	api.cfg.oidcProviders["mock"] = provider
+
+	return api, issuer
+}
+
+// startOIDCLogin starts signing in with the mock issuer and returns the
+// state Chirpy sent along and the URL the user was redirected to
+func (api *testAPI) startOIDCLogin() (string, string) {
+	api.t.Helper()
+
+	res := api.do(http.MethodGet, "/api/auth/oidc/mock/login", "", nil, nil)
+	if res.StatusCode != http.StatusFound {
+		api.t.Fatalf("starting OIDC login: status %d", res.StatusCode)
+	}
+	auth_url := res.Header.Get("Location")
+
+	parsed, err := url.Parse(auth_url)
+	if err != nil {
+		api.t.Fatalf("parsing redirect: %v", err)
+	}
+	return parsed.Query().Get("state"), auth_url
+}
+
+// finishOIDCLogin calls the callback with state and code
+func (api *testAPI) finishOIDCLogin(state, code string, out interface{}) *http.Response {
+	api.t.Helper()
+
+	query := url.Values{}
+	query.Set("state", state)
+	query.Set("code", code)
+	return api.do(http.MethodGet, "/api/auth/oidc/mock/callback?"+query.Encode(), "", nil, out)
+}
+
+func verifiedClaims(subject, email string) oidc.Claims {
+	claims := oidc.Claims{Email: email, EmailVerified: true}
+	claims.Subject = subject
+	return claims
+}
+
+func TestOIDCLogin(t *testing.T) {
+	api, issuer := newOIDCTestAPI(t)
+
+	state, auth_url := api.startOIDCLogin()
+	login := loginResponse{}
+	res := api.finishOIDCLogin(state, issuer.authorize(auth_url, verifiedClaims("sub-1", "oidc@example.com")), &login)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("callback: status %d", res.StatusCode)
+	}
+	if login.Token == "" || login.RefreshToken == "" || login.Email != "oidc@example.com" {
+		t.Fatalf("got login %+v, want a session for oidc@example.com", login)
+	}
+
+	user, err := api.cfg.db.GetUserById(context.Background(), login.Id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if !user.EmailVerified || user.Password != "" {
+		t.Fatalf("new user verified=%t with password %q, want verified with no password", user.EmailVerified, user.Password)
+	}
+
+	// Signing in again finds the linked identity, even under another email
+	state, auth_url = api.startOIDCLogin()
+	again := loginResponse{}
+	res = api.finishOIDCLogin(state, issuer.authorize(auth_url, verifiedClaims("sub-1", "renamed@example.com")), &again)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("second callback: status %d", res.StatusCode)
+	}
+	if again.Id != login.Id {
+		t.Fatalf("second sign in got user %d, want %d", again.Id, login.Id)
+	}
+}
+
+func TestOIDCCallbackRejectsMismatches(t *testing.T) {
+	claims := verifiedClaims("sub-1", "oidc@example.com")
+
+	tests := []struct {
+		name string
+		// callback returns the state and code to call back with
+		callback func(api *testAPI, issuer *mockIssuer) (string, string)
+		want     int
+	}{
+		{
+			name: "unknown state",
+			callback: func(api *testAPI, issuer *mockIssuer) (string, string) {
+				_, auth_url := api.startOIDCLogin()
+				return "forged-state", issuer.authorize(auth_url, claims)
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "replayed state",
+			callback: func(api *testAPI, issuer *mockIssuer) (string, string) {
+				state, auth_url := api.startOIDCLogin()
+				res := api.finishOIDCLogin(state, issuer.authorize(auth_url, claims), nil)
+				if res.StatusCode != http.StatusOK {
+					api.t.Fatalf("first callback: status %d", res.StatusCode)
+				}
+				return state, issuer.authorize(auth_url, claims)
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "nonce mismatch",
+			callback: func(api *testAPI, issuer *mockIssuer) (string, string) {
+				state, auth_url := api.startOIDCLogin()
+				issuer.nonce = "replayed-nonce"
+				return state, issuer.authorize(auth_url, claims)
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "code from another login",
+			callback: func(api *testAPI, issuer *mockIssuer) (string, string) {
+				// An attacker's code injected into the victim's login fails
+				// PKCE, because the victim's verifier doesn't match it
+				_, attacker_url := api.startOIDCLogin()
+				state, _ := api.startOIDCLogin()
+				return state, issuer.authorize(attacker_url, claims)
+			},
+			want: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			api, issuer := newOIDCTestAPI(t)
+
+			state, code := tc.callback(api, issuer)
+			res := api.finishOIDCLogin(state, code, nil)
+			if res.StatusCode != tc.want {
+				t.Fatalf("callback: status %d, want %d", res.StatusCode, tc.want)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginSetsStateCookie(t *testing.T) {
+	api, _ := newOIDCTestAPI(t)
+
+	state, _ := api.startOIDCLogin()
+	cookie, ok := api.cookies[oidcStateCookie]
+	if !ok {
+		t.Fatal("starting a login set no state cookie")
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("state cookie HttpOnly=%t SameSite=%v, want HttpOnly and Lax", cookie.HttpOnly, cookie.SameSite)
+	}
+	if cookie.MaxAge <= 0 || cookie.MaxAge > int(oidcLoginExpiry.Seconds()) {
+		t.Errorf("state cookie MaxAge = %d, want at most the login expiry", cookie.MaxAge)
+	}
+	if cookie.Value == state {
+		t.Error("state cookie holds the state itself, want its hash")
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	claims := verifiedClaims("sub-1", "oidc@example.com")
+
+	t.Run("missing cookie", func(t *testing.T) {
+		api, issuer := newOIDCTestAPI(t)
+
+		state, auth_url := api.startOIDCLogin()
+		cookie := api.cookies[oidcStateCookie]
+		delete(api.cookies, oidcStateCookie)
+
+		res := api.finishOIDCLogin(state, issuer.authorize(auth_url, claims), nil)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("callback without cookie: status %d, want %d", res.StatusCode, http.StatusBadRequest)
+		}
+
+		// The rejected callback didn't use the state up
+		api.cookies[oidcStateCookie] = cookie
+		res = api.finishOIDCLogin(state, issuer.authorize(auth_url, claims), nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("callback with cookie: status %d, want %d", res.StatusCode, http.StatusOK)
+		}
+		if _, ok := api.cookies[oidcStateCookie]; ok {
+			t.Error("state cookie survived the callback")
+		}
+	})
+
+	t.Run("login from another browser", func(t *testing.T) {
+		api, issuer := newOIDCTestAPI(t)
+
+		// The attacker starts a login and lures the victim, who has
+		// a login of their own in progress, to the attacker's callback
+		attacker_state, attacker_url := api.startOIDCLogin()
+		delete(api.cookies, oidcStateCookie)
+		api.startOIDCLogin()
+
+		res := api.finishOIDCLogin(attacker_state, issuer.authorize(attacker_url, claims), nil)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("callback with another browser's state: status %d, want %d", res.StatusCode, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestOIDCLinksExistingAccount(t *testing.T) {
+	tests := []struct {
+		name           string
+		local_verified bool
+		claims         oidc.Claims
+		want           int
+		keeps_password bool
+	}{
+		{
+			name:           "verified local account",
+			local_verified: true,
+			claims:         verifiedClaims("sub-1", "user@example.com"),
+			want:           http.StatusOK,
+			keeps_password: true,
+		},
+		{
+			name:           "unverified local account",
+			local_verified: false,
+			claims:         verifiedClaims("sub-1", "user@example.com"),
+			want:           http.StatusOK,
+			keeps_password: false,
+		},
+		{
+			name:           "email not verified by the provider",
+			local_verified: false,
+			claims:         oidc.Claims{Email: "user@example.com", RegisteredClaims: jwt.RegisteredClaims{Subject: "sub-1"}},
+			want:           http.StatusConflict,
+			keeps_password: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			api, issuer := newOIDCTestAPI(t)
+			user := api.createUser("user@example.com")
+			if tc.local_verified {
+				_, err := api.cfg.db.VerifyUserEmail(context.Background(), user.Id, user.Email)
+				if err != nil {
+					t.Fatalf("VerifyUserEmail: %v", err)
+				}
+			}
+			session := api.login("user@example.com", testPassword)
+
+			state, auth_url := api.startOIDCLogin()
+			login := loginResponse{}
+			res := api.finishOIDCLogin(state, issuer.authorize(auth_url, tc.claims), &login)
+			if res.StatusCode != tc.want {
+				t.Fatalf("callback: status %d, want %d", res.StatusCode, tc.want)
+			}
+			if tc.want == http.StatusOK && login.Id != user.Id {
+				t.Fatalf("identity linked to user %d, want %d", login.Id, user.Id)
+			}
+
+			res = api.do(http.MethodPost, "/api/login", "", map[string]string{
+				"email":    "user@example.com",
+				"password": testPassword,
+			}, nil)
+			if got := res.StatusCode == http.StatusOK; got != tc.keeps_password {
+				t.Fatalf("password login after linking: status %d, want password kept %t", res.StatusCode, tc.keeps_password)
+			}
+
+			// Sessions of whoever signed up without proving the email end too
+			res = api.do(http.MethodPost, "/api/refresh", session.RefreshToken, nil, nil)
+			if got := res.StatusCode == http.StatusOK; got != tc.keeps_password {
+				t.Fatalf("refreshing the old session: status %d, want session kept %t", res.StatusCode, tc.keeps_password)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Hien-Trinh/chirpy/internal/password"
+)
+
+// checkPassword responds 400 with every policy violation and returns false
+// when a new password isn't acceptable
+func (a *apiConfig) checkPassword(w http.ResponseWriter, new_password string) bool {
+	violations, err := a.passwordPolicy.Check(new_password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't check password: %s", err))
+		return false
+	}
+
+	if len(violations) > 0 {
+		respondWithJSON(w, http.StatusBadRequest, struct {
+			Error      string               `json:"error"`
+			Violations []password.Violation `json:"violations"`
+			RequestID  string               `json:"request_id,omitempty"`
+		}{
+			Error:      "Password doesn't meet the password policy",
+			Violations: violations,
+			RequestID:  requestID(w),
+		})
+		return false
+	}
+
+	return true
+}
+
+// newPasswordPolicy configures the password policy from PASSWORD_MIN_LENGTH,
+// PASSWORD_MAX_BYTES, PASSWORD_MIN_CLASSES and, for the breach check,
+// PASSWORD_BREACH_LIST and PASSWORD_BREACH_MIN_COUNT
+func newPasswordPolicy() (password.Policy, error) {
+	policy := password.DefaultPolicy
+	policy.MinLength = envInt("PASSWORD_MIN_LENGTH", policy.MinLength)
+	policy.MaxBytes = envInt("PASSWORD_MAX_BYTES", policy.MaxBytes)
+	policy.MinClasses = envInt("PASSWORD_MIN_CLASSES", policy.MinClasses)
+
+	if dir := os.Getenv("PASSWORD_BREACH_LIST"); dir != "" {
+		breaches, err := password.NewBreachList(dir, envInt("PASSWORD_BREACH_MIN_COUNT", 1))
+		if err != nil {
+			return password.Policy{}, err
+		}
+		policy.Breaches = breaches
+	}
+
+	return policy, nil
+}
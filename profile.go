@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// publicUser is the view of a user that is safe to show to anyone
+type publicUser struct {
+	Id          int       `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newPublicUser(user database.User) publicUser {
+	return publicUser{
+		Id:          user.Id,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		IsChirpyRed: user.IsChirpyRed,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+// handlerUsersGetById returns the public profile of a user by ID
+func (a *apiConfig) handlerUsersGetById(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return
+	}
+
+	user, err := a.db.GetUserById(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't get user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newPublicUser(user))
+}
+
+// handlerUsersGetByHandle returns the public profile of a user by handle
+func (a *apiConfig) handlerUsersGetByHandle(w http.ResponseWriter, r *http.Request) {
+	user, err := a.db.GetUserByHandle(r.Context(), r.PathValue("handle"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't get user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newPublicUser(user))
+}
+
+// handlerUsersMePatch updates the profile of the authenticated user.
+// Fields left out of the request body keep their current value, even
+// when another request changes them at the same time.
+func (a *apiConfig) handlerUsersMePatch(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	type parameters struct {
+		Handle      *string `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	profile := database.UserProfile{
+		Handle:      params.Handle,
+		DisplayName: trimSpace(params.DisplayName),
+		Bio:         trimSpace(params.Bio),
+		AvatarURL:   trimSpace(params.AvatarURL),
+	}
+
+	err = validateProfile(profile)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid profile: %s", err))
+		return
+	}
+
+	user_updated, err := a.db.UpdateUserProfile(r.Context(), user.Id, profile)
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, http.StatusConflict, "Handle is already taken")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newPublicUser(user_updated))
+}
+
+// validateHandle checks that a non-empty handle only uses letters, digits and underscores
+func validateHandle(handle string) error {
+	if handle != "" && !handlePattern.MatchString(handle) {
+		return errors.New("handle must be 3-30 letters, digits or underscores")
+	}
+
+	return nil
+}
+
+// validateProfile checks the fields set in profile
+func validateProfile(profile database.UserProfile) error {
+	if profile.Handle != nil {
+		err := validateHandle(*profile.Handle)
+		if err != nil {
+			return err
+		}
+	}
+
+	if profile.DisplayName != nil && utf8.RuneCountInString(*profile.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("display name must be at most %d characters", maxDisplayNameLength)
+	}
+
+	if profile.Bio != nil && utf8.RuneCountInString(*profile.Bio) > maxBioLength {
+		return fmt.Errorf("bio must be at most %d characters", maxBioLength)
+	}
+
+	if profile.AvatarURL != nil && *profile.AvatarURL != "" {
+		if len(*profile.AvatarURL) > maxAvatarURLLength {
+			return errors.New("avatar URL is too long")
+		}
+		avatar_url, err := url.Parse(*profile.AvatarURL)
+		if err != nil || (avatar_url.Scheme != "http" && avatar_url.Scheme != "https") || avatar_url.Host == "" {
+			return errors.New("avatar URL must be an absolute http or https URL")
+		}
+	}
+
+	return nil
+}
+
+// trimSpace trims s unless it is nil
+func trimSpace(s *string) *string {
+	if s == nil {
+		return nil
+	}
+
+	trimmed := strings.TrimSpace(*s)
+	return &trimmed
+}
@@ -1,29 +1,58 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/token"
 )
 
+// handlerRefreshPost exchanges a refresh token for a new access token
+// and a new refresh token. The old refresh token stops working, and
+// presenting it again revokes every token rotated from it.
 func (a *apiConfig) handlerRefreshPost(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	refresh_token, err := a.db.GetRefreshTokensByToken(token)
+	refresh_token_string, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token")
+		respondWithAuthError(w, err)
 		return
 	}
 
-	token_signed, err := auth.CreateJWT(a.jwtSecret, refresh_token.UserID)
+	new_refresh_token_string, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create refresh token: %s", err))
+		return
+	}
+
+	refresh_token, err := a.db.RotateRefreshToken(r.Context(), token.Hash(refresh_token_string), token.Hash(new_refresh_token_string), clientUserAgent(r), clientIP(r))
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token was already used, session has been revoked")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Couldn't get refresh token: %s", err))
+		return
+	}
+
+	user, err := a.db.GetUserById(r.Context(), refresh_token.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't get user")
+		return
+	}
+
+	token_signed, err := a.tokens.Create(user.Id, user.Role)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create token")
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}{
-		Token: token_signed,
+		Token:        token_signed,
+		RefreshToken: new_refresh_token_string,
 	})
 }
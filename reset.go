@@ -3,7 +3,7 @@ package main
 import "net/http"
 
 func (a *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
-	a.fileserverHits = 0
+	a.metrics.fileserverHits.Reset()
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Hits reset"))
@@ -2,27 +2,104 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/entitlements"
 )
 
+// respondWithError responds with {"error": msg}. Error bodies also carry
+// the request ID, so a user's report can be matched to the logs.
 func respondWithError(w http.ResponseWriter, code int, msg string) {
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		slog.Error("Responding with 5XX error", "request_id", requestID(w), "status", code, "error", msg)
 	}
 	type errorResponse struct {
-		Error string `json:"error"`
+		Error     string `json:"error"`
+		RequestID string `json:"request_id,omitempty"`
 	}
 	respondWithJSON(w, code, errorResponse{
-		Error: msg,
+		Error:     msg,
+		RequestID: requestID(w),
 	})
 }
 
+// respondWithErrorCode responds like respondWithError, adding a
+// machine-readable code clients can branch on
+func respondWithErrorCode(w http.ResponseWriter, status int, code, msg string) {
+	respondWithJSON(w, status, struct {
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+		RequestID string `json:"request_id,omitempty"`
+	}{
+		Error:     msg,
+		Code:      code,
+		RequestID: requestID(w),
+	})
+}
+
+// respondWithPremiumRequired responds 402 to a free user trying a premium feature
+func respondWithPremiumRequired(w http.ResponseWriter, feature entitlements.Feature, msg string) {
+	respondWithJSON(w, http.StatusPaymentRequired, struct {
+		Error     string               `json:"error"`
+		Code      string               `json:"code"`
+		Feature   entitlements.Feature `json:"feature"`
+		RequestID string               `json:"request_id,omitempty"`
+	}{
+		Error:     msg,
+		Code:      "premium_required",
+		Feature:   feature,
+		RequestID: requestID(w),
+	})
+}
+
+// respondWithAuthError responds to a request that failed authentication,
+// with a WWW-Authenticate challenge as described in RFC 6750
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrNoAuthHeader) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+		respondWithError(w, http.StatusUnauthorized, "Authentication is required")
+		return
+	}
+
+	if errors.Is(err, auth.ErrMalformedAuthHeader) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy", error="invalid_request", error_description="Malformed Authorization header"`)
+		respondWithError(w, http.StatusBadRequest, "Authorization header must use the Bearer scheme")
+		return
+	}
+
+	msg := "Token is invalid"
+	switch {
+	case errors.Is(err, auth.ErrTokenMalformed):
+		msg = "Token is malformed"
+	case errors.Is(err, auth.ErrTokenExpired):
+		msg = "Token has expired"
+	case errors.Is(err, auth.ErrTokenSignature):
+		msg = "Token signature is invalid"
+	case errors.Is(err, auth.ErrTokenWrongIssuer):
+		msg = "Token was issued by someone else"
+	case errors.Is(err, auth.ErrTokenWrongAudience):
+		msg = "Token is not meant for this service"
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="invalid_token", error_description=%q`, msg))
+	respondWithError(w, http.StatusUnauthorized, msg)
+}
+
+// respondWithInsufficientScope responds 403 to an authenticated caller
+// who isn't allowed to make the request
+func respondWithInsufficientScope(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", error_description=%q`, msg))
+	respondWithError(w, http.StatusForbidden, msg)
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("Error marshalling JSON", "request_id", requestID(w), "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -3,18 +3,25 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"strings"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/token"
 )
 
 func (a *apiConfig) handlerRevokePost(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	refresh_token, err := a.db.GetRefreshTokensByToken(token)
+	refresh_token_string, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	refresh_token, err := a.db.GetRefreshTokenByHash(r.Context(), token.Hash(refresh_token_string))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token")
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Couldn't get refresh token: %s", err))
 		return
 	}
 
-	err = a.db.RevokeRefreshToken(refresh_token.Id)
+	err = a.db.RevokeRefreshTokenFamily(r.Context(), refresh_token.FamilyId)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't revoke token: %s", err))
 		return
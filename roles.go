@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+// middlewareRequireRole only lets a request through when the user has
+// a role of at least the required one. The role is read from the
+// database rather than the JWT, so a demotion takes effect right away.
+// Personal access tokens never grant a role.
+func (a *apiConfig) middlewareRequireRole(role database.Role, next http.HandlerFunc) http.HandlerFunc {
+	return a.middlewareAuth(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		if !principal.User.Role.AtLeast(role) {
+			respondWithInsufficientScope(w, fmt.Sprintf("This requires the %s role", role))
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// handlerAdminUsersRolePut changes the role of a user
+func (a *apiConfig) handlerAdminUsersRolePut(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return
+	}
+
+	type parameters struct {
+		Role database.Role `json:"role"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if !params.Role.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Role must be user, moderator or admin")
+		return
+	}
+
+	user, err := a.db.UpdateUserRole(r.Context(), id, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newPrivateUser(user))
+}
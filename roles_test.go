@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+func TestRequireRoleUsesCurrentRole(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	user := api.createUser("admin@example.com")
+
+	_, err := api.cfg.db.UpdateUserRole(ctx, user.Id, database.RoleAdmin)
+	if err != nil {
+		t.Fatalf("UpdateUserRole: %v", err)
+	}
+	login := api.login("admin@example.com", testPassword)
+
+	res := api.do(http.MethodGet, "/admin/failed-logins", login.Token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("admin: status %d, want 200", res.StatusCode)
+	}
+
+	// The access token still says admin
+	_, err = api.cfg.db.UpdateUserRole(ctx, user.Id, database.RoleUser)
+	if err != nil {
+		t.Fatalf("UpdateUserRole: %v", err)
+	}
+
+	res = api.do(http.MethodGet, "/admin/failed-logins", login.Token, nil, nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("demoted admin: status %d, want 403", res.StatusCode)
+	}
+}
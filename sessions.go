@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+)
+
+const maxUserAgentLength = 256
+
+type session struct {
+	Id         int       `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// handlerSessionsGet lists the devices the authenticated user is logged in on.
+// A session is a family of rotated refresh tokens and is identified by its family ID.
+func (a *apiConfig) handlerSessionsGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	refresh_tokens, err := a.db.GetSessionsByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get sessions: %s", err))
+		return
+	}
+
+	sessions := make([]session, 0, len(refresh_tokens))
+	for _, refresh_token := range refresh_tokens {
+		sessions = append(sessions, session{
+			Id:         refresh_token.FamilyId,
+			CreatedAt:  refresh_token.CreatedAt,
+			LastUsedAt: refresh_token.LastUsedAt,
+			ExpiresAt:  refresh_token.ExpiresAt,
+			UserAgent:  refresh_token.UserAgent,
+			IP:         refresh_token.IP,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+// handlerSessionsDeleteById logs the authenticated user out of one session
+func (a *apiConfig) handlerSessionsDeleteById(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return
+	}
+
+	refresh_tokens, err := a.db.GetSessionsByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get sessions: %s", err))
+		return
+	}
+
+	for _, refresh_token := range refresh_tokens {
+		if refresh_token.FamilyId == id {
+			err = a.db.RevokeRefreshTokenFamily(r.Context(), id)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't revoke session: %s", err))
+				return
+			}
+
+			respondWithJSON(w, http.StatusNoContent, nil)
+			return
+		}
+	}
+
+	respondWithError(w, http.StatusNotFound, "Session not found")
+}
+
+// handlerSessionsDelete logs the authenticated user out everywhere
+func (a *apiConfig) handlerSessionsDelete(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	err := a.db.RevokeRefreshTokensByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't revoke sessions: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// clientIP returns the address of the peer that sent the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// clientUserAgent returns the User-Agent of the request, truncated for storage
+func clientUserAgent(r *http.Request) string {
+	user_agent := r.UserAgent()
+	if len(user_agent) > maxUserAgentLength {
+		// Cut before the character that crosses the limit, not inside it
+		end := maxUserAgentLength
+		for end > 0 && !utf8.RuneStart(user_agent[end]) {
+			end--
+		}
+		user_agent = user_agent[:end]
+	}
+
+	return user_agent
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestClientUserAgent(t *testing.T) {
+	tests := []struct {
+		name       string
+		user_agent string
+		want       string
+	}{
+		{"short", "curl/8.0", "curl/8.0"},
+		{"at limit", strings.Repeat("a", maxUserAgentLength), strings.Repeat("a", maxUserAgentLength)},
+		{"ascii over limit", strings.Repeat("a", maxUserAgentLength+10), strings.Repeat("a", maxUserAgentLength)},
+		// "é" is 2 bytes, so the limit falls inside the last one that fits
+		{"split two-byte rune", "a" + strings.Repeat("é", maxUserAgentLength), "a" + strings.Repeat("é", (maxUserAgentLength-1)/2)},
+		// "€" is 3 bytes
+		{"split three-byte rune", strings.Repeat("€", maxUserAgentLength), strings.Repeat("€", maxUserAgentLength/3)},
+		// "🐦" is 4 bytes, and 256 is a multiple of 4
+		{"rune ends at limit", strings.Repeat("🐦", maxUserAgentLength), strings.Repeat("🐦", maxUserAgentLength/4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("User-Agent", tt.user_agent)
+
+			got := clientUserAgent(r)
+			if got != tt.want {
+				t.Errorf("got %d bytes %q, want %d bytes", len(got), got, len(tt.want))
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("got invalid UTF-8 %q", got)
+			}
+			if len(got) > maxUserAgentLength {
+				t.Errorf("got %d bytes, over the limit", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+func newShutdownDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	return db
+}
+
+func TestShutdownClosesDBWhenDrained(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	db := newShutdownDB(t)
+
+	ok := shutdown(srv.Config, &sync.WaitGroup{}, db, func(context.Context) error { return nil }, time.Second)
+	if !ok {
+		t.Fatal("shutdown reported failure")
+	}
+
+	_, err := db.GetChirps(context.Background(), 0, 0, false)
+	if err != database.ErrClosed {
+		t.Fatalf("GetChirps after shutdown = %v, want ErrClosed", err)
+	}
+}
+
+func TestShutdownLeavesDBOpenWhenRequestsHang(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	db := newShutdownDB(t)
+
+	go http.Get(srv.URL)
+	<-started
+
+	var trace_err error
+	shutdownTracing := func(ctx context.Context) error {
+		trace_err = ctx.Err()
+		return nil
+	}
+
+	ok := shutdown(srv.Config, &sync.WaitGroup{}, db, shutdownTracing, 50*time.Millisecond)
+	if ok {
+		t.Fatal("shutdown reported success with a request still running")
+	}
+
+	_, err := db.GetChirps(context.Background(), 0, 0, false)
+	if err != nil {
+		t.Fatalf("GetChirps after failed shutdown: %v", err)
+	}
+	if trace_err != nil {
+		t.Fatalf("traces were flushed with an expired context: %v", trace_err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+type subscription struct {
+	Plan             database.SubscriptionPlan   `json:"plan"`
+	Status           database.SubscriptionStatus `json:"status"`
+	StartedAt        time.Time                   `json:"started_at"`
+	CurrentPeriodEnd *time.Time                  `json:"current_period_end"`
+	CancelAt         *time.Time                  `json:"cancel_at"`
+	EndedAt          *time.Time                  `json:"ended_at"`
+}
+
+func newSubscription(stored database.Subscription) *subscription {
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+
+	return &subscription{
+		Plan:             stored.Plan,
+		Status:           stored.Status,
+		StartedAt:        stored.StartedAt,
+		CurrentPeriodEnd: optional(stored.CurrentPeriodEnd),
+		CancelAt:         optional(stored.CancelAt),
+		EndedAt:          optional(stored.EndedAt),
+	}
+}
+
+// handlerUsersMeSubscriptionGet returns the Chirpy Red membership of the
+// authenticated user along with their latest subscription, if any
+func (a *apiConfig) handlerUsersMeSubscriptionGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	subscriptions, err := a.db.GetSubscriptionsByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get subscriptions: %s", err))
+		return
+	}
+
+	response := struct {
+		IsChirpyRed  bool          `json:"is_chirpy_red"`
+		Subscription *subscription `json:"subscription"`
+	}{
+		IsChirpyRed: user.IsChirpyRed,
+	}
+	if len(subscriptions) > 0 {
+		response.Subscription = newSubscription(subscriptions[0])
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// expireSubscriptions ends lapsed subscriptions every interval until ctx is done
+func (a *apiConfig) expireSubscriptions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := a.db.ExpireSubscriptions(ctx, time.Now())
+		if err != nil {
+			log.Printf("Couldn't expire subscriptions: %s", err)
+		} else if expired > 0 {
+			log.Printf("Expired %d subscriptions", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+const (
+	maxTokenNameLength      = 100
+	maxPersonalAccessTokens = 50
+)
+
+type personalAccessToken struct {
+	Id         int              `json:"id"`
+	Name       string           `json:"name"`
+	Hint       string           `json:"hint"`
+	Scopes     []database.Scope `json:"scopes"`
+	CreatedAt  time.Time        `json:"created_at"`
+	ExpiresAt  *time.Time       `json:"expires_at"`
+	LastUsedAt *time.Time       `json:"last_used_at"`
+}
+
+func newPersonalAccessToken(stored database.PersonalAccessToken) personalAccessToken {
+	personal_access_token := personalAccessToken{
+		Id:        stored.Id,
+		Name:      stored.Name,
+		Hint:      stored.Hint,
+		Scopes:    stored.Scopes,
+		CreatedAt: stored.CreatedAt,
+	}
+	if !stored.ExpiresAt.IsZero() {
+		personal_access_token.ExpiresAt = &stored.ExpiresAt
+	}
+	if !stored.LastUsedAt.IsZero() {
+		personal_access_token.LastUsedAt = &stored.LastUsedAt
+	}
+
+	return personal_access_token
+}
+
+// handlerTokensPost mints a personal access token for the authenticated user.
+// The token itself is only ever shown in this response.
+func (a *apiConfig) handlerTokensPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	type parameters struct {
+		Name          string           `json:"name"`
+		Scopes        []database.Scope `json:"scopes"`
+		ExpiresInDays int              `json:"expires_in_days"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if params.Name == "" || len(params.Name) > maxTokenNameLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Name is required and must be at most %d characters", maxTokenNameLength))
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !scope.Valid() {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown scope %q", scope))
+			return
+		}
+	}
+	if params.ExpiresInDays < 0 {
+		respondWithError(w, http.StatusBadRequest, "Expiry must not be negative")
+		return
+	}
+
+	expires_at := time.Time{}
+	if params.ExpiresInDays > 0 {
+		expires_at = time.Now().AddDate(0, 0, params.ExpiresInDays).UTC()
+	}
+
+	token_string, token_hash, hint, err := auth.NewPersonalAccessToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
+		return
+	}
+
+	stored, err := a.db.CreatePersonalAccessToken(r.Context(), user.Id, params.Name, hint, token_hash, params.Scopes, expires_at, maxPersonalAccessTokens)
+	if errors.Is(err, database.ErrTooManyPersonalAccessTokens) {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("You can have at most %d tokens", maxPersonalAccessTokens))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, struct {
+		personalAccessToken
+		Token string `json:"token"`
+	}{
+		personalAccessToken: newPersonalAccessToken(stored),
+		Token:               token_string,
+	})
+}
+
+// handlerTokensGet lists the personal access tokens of the authenticated user
+func (a *apiConfig) handlerTokensGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	stored, err := a.db.GetPersonalAccessTokensByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get tokens: %s", err))
+		return
+	}
+
+	personal_access_tokens := make([]personalAccessToken, 0, len(stored))
+	for _, personal_access_token := range stored {
+		personal_access_tokens = append(personal_access_tokens, newPersonalAccessToken(personal_access_token))
+	}
+	sort.Slice(personal_access_tokens, func(i, j int) bool { return personal_access_tokens[i].Id < personal_access_tokens[j].Id })
+
+	respondWithJSON(w, http.StatusOK, personal_access_tokens)
+}
+
+// handlerTokensDeleteById revokes a personal access token of the authenticated user
+func (a *apiConfig) handlerTokensDeleteById(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return
+	}
+
+	err = a.db.DeletePersonalAccessToken(r.Context(), user.Id, id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+)
+
+// mintedToken is the body of a successful POST /api/tokens
+type mintedToken struct {
+	Id    int    `json:"id"`
+	Hint  string `json:"hint"`
+	Token string `json:"token"`
+}
+
+// mintToken mints a personal access token with scopes through the API
+func (api *testAPI) mintToken(session string, scopes ...database.Scope) mintedToken {
+	api.t.Helper()
+
+	minted := mintedToken{}
+	res := api.do(http.MethodPost, "/api/tokens", session, map[string]interface{}{
+		"name":   "script",
+		"scopes": scopes,
+	}, &minted)
+	if res.StatusCode != http.StatusCreated {
+		api.t.Fatalf("minting a token: status %d", res.StatusCode)
+	}
+	return minted
+}
+
+func TestPersonalAccessTokenShownOnce(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+	login := api.login("user@example.com", testPassword)
+
+	minted := api.mintToken(login.Token, database.ScopeChirpsRead)
+	if !strings.HasPrefix(minted.Token, auth.PersonalAccessTokenPrefix) {
+		t.Fatalf("minted token %q, want the %s prefix", minted.Token, auth.PersonalAccessTokenPrefix)
+	}
+	if !strings.HasPrefix(minted.Token, minted.Hint) || minted.Hint == minted.Token {
+		t.Fatalf("hint %q, want a short prefix of the token", minted.Hint)
+	}
+
+	res := api.do(http.MethodGet, "/api/tokens", login.Token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("listing tokens: status %d", res.StatusCode)
+	}
+	listing, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading listing: %v", err)
+	}
+	if strings.Contains(string(listing), minted.Token) {
+		t.Fatal("listing tokens shows the token itself")
+	}
+	if !strings.Contains(string(listing), minted.Hint) {
+		t.Fatalf("listing %s doesn't show the hint", listing)
+	}
+}
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+	login := api.login("user@example.com", testPassword)
+
+	read := api.mintToken(login.Token, database.ScopeChirpsRead).Token
+	write := api.mintToken(login.Token, database.ScopeChirpsWrite).Token
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		want   int
+	}{
+		{"read scope reads", http.MethodGet, "/api/chirps", read, nil, http.StatusOK},
+		{"write scope posts", http.MethodPost, "/api/chirps", write, map[string]string{"body": "hello"}, http.StatusCreated},
+		{"read scope can't post", http.MethodPost, "/api/chirps", read, map[string]string{"body": "hello"}, http.StatusForbidden},
+		{"write scope can't read", http.MethodGet, "/api/chirps", write, nil, http.StatusForbidden},
+		{"write scope can't edit profile", http.MethodPatch, "/api/users/me", write, map[string]string{"bio": "hi"}, http.StatusForbidden},
+		// Routes without scopes are only open to sessions
+		{"can't mint tokens", http.MethodPost, "/api/tokens", write, map[string]interface{}{"name": "more", "scopes": []string{"chirps:write"}}, http.StatusForbidden},
+		{"can't list tokens", http.MethodGet, "/api/tokens", read, nil, http.StatusForbidden},
+		{"can't change password", http.MethodPut, "/api/users/me/password", write, map[string]string{"current_password": testPassword, "new_password": "battery staple"}, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		res := api.do(tc.method, tc.path, tc.token, tc.body, nil)
+		if res.StatusCode != tc.want {
+			t.Errorf("%s: %s %s = %d, want %d", tc.name, tc.method, tc.path, res.StatusCode, tc.want)
+			continue
+		}
+		if tc.want == http.StatusForbidden && !strings.Contains(res.Header.Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+			t.Errorf("%s: WWW-Authenticate = %q, want insufficient_scope", tc.name, res.Header.Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestPersonalAccessTokenExpiredOrRevoked(t *testing.T) {
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+	login := api.login("user@example.com", testPassword)
+
+	revoked := api.mintToken(login.Token, database.ScopeChirpsRead)
+	res := api.do(http.MethodGet, "/api/chirps", revoked.Token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fresh token: status %d", res.StatusCode)
+	}
+	res = api.do(http.MethodDelete, "/api/tokens/"+strconv.Itoa(revoked.Id), login.Token, nil, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoking a token: status %d", res.StatusCode)
+	}
+
+	// Tokens can't be minted already expired through the API
+	expired, expired_hash, hint, err := auth.NewPersonalAccessToken()
+	if err != nil {
+		t.Fatalf("NewPersonalAccessToken: %v", err)
+	}
+	_, err = api.cfg.db.CreatePersonalAccessToken(context.Background(), user.Id, "old", hint, expired_hash,
+		[]database.Scope{database.ScopeChirpsRead}, time.Now().Add(-time.Minute).UTC(), maxPersonalAccessTokens)
+	if err != nil {
+		t.Fatalf("CreatePersonalAccessToken: %v", err)
+	}
+
+	for name, token := range map[string]string{"revoked": revoked.Token, "expired": expired} {
+		res := api.do(http.MethodGet, "/api/chirps", token, nil, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s token: status %d, want %d", name, res.StatusCode, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestPersonalAccessTokenLimitIsAtomic(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+	login := api.login("user@example.com", testPassword)
+
+	for i := 0; i < maxPersonalAccessTokens-1; i++ {
+		api.mintToken(login.Token, database.ScopeChirpsRead)
+	}
+
+	// Only one of these fits under the limit
+	const attempts = 5
+	statuses := make([]int, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := api.do(http.MethodPost, "/api/tokens", login.Token, map[string]interface{}{
+				"name":   "racer",
+				"scopes": []database.Scope{database.ScopeChirpsRead},
+			}, nil)
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != attempts-1 {
+		t.Fatalf("statuses = %v, want one created and the rest conflicting", counts)
+	}
+}
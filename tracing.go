@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/Hien-Trinh/chirpy")
+
+// middlewareTrace starts a server span for every request, named after
+// the mux pattern that handles it and continuing the caller's trace when
+// the request carries a traceparent header
+func (a *apiConfig) middlewareTrace(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		method := metricsMethod(r.Method)
+		route := routePattern(mux, r)
+		name := method
+		if route != "unmatched" {
+			name += " " + route
+		}
+		client_address, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client_address = r.RemoteAddr
+		}
+
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+				semconv.ClientAddress(client_address),
+			),
+		)
+		defer span.End()
+
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// tracePrincipal tags the request's span with the authenticated user
+func tracePrincipal(ctx context.Context, principal *auth.Principal) {
+	trace.SpanFromContext(ctx).SetAttributes(semconv.EnduserID(strconv.Itoa(principal.User.Id)))
+}
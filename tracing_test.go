@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Hien-Trinh/chirpy/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanExporter     = tracetest.NewInMemoryExporter()
+	spanExporterOnce sync.Once
+)
+
+// recordSpans installs tracing with an in-memory exporter, as main does
+// with OTLP, and returns a function that flushes and returns the spans
+// recorded since. The tracer provider is global and only the first one
+// installed reaches the package tracers, so every test shares it.
+func recordSpans(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+
+	spanExporterOnce.Do(func() {
+		_, err := tracing.Setup(context.Background(), spanExporter, "chirpy-test")
+		if err != nil {
+			t.Fatalf("tracing.Setup: %v", err)
+		}
+	})
+	provider := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+
+	err := provider.ForceFlush(context.Background())
+	if err != nil {
+		t.Fatalf("ForceFlush: %v", err)
+	}
+	spanExporter.Reset()
+
+	return func() tracetest.SpanStubs {
+		t.Helper()
+
+		err := provider.ForceFlush(context.Background())
+		if err != nil {
+			t.Fatalf("ForceFlush: %v", err)
+		}
+		return spanExporter.GetSpans()
+	}
+}
+
+// serverSpan returns the single server span among spans
+func serverSpan(t *testing.T, spans tracetest.SpanStubs) tracetest.SpanStub {
+	t.Helper()
+
+	found := []tracetest.SpanStub{}
+	for _, span := range spans {
+		if span.SpanKind == trace.SpanKindServer {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("got %d server spans, want 1", len(found))
+	}
+	return found[0]
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestServerSpanNamedByRoute(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		path  string
+		name  string
+		route string
+	}{
+		{"/api/chirps/123", "GET /api/chirps/{id}", "/api/chirps/{id}"},
+		{"/api/chirps", "GET /api/chirps", "/api/chirps"},
+		{"/api/nothing-here", "GET", "unmatched"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			spans := recordSpans(t)
+			api.do(http.MethodGet, tc.path, "", nil, nil)
+
+			span := serverSpan(t, spans())
+			if span.Name != tc.name {
+				t.Fatalf("span name = %q, want %q", span.Name, tc.name)
+			}
+			if route := spanAttribute(span, "http.route"); route != tc.route {
+				t.Fatalf("http.route = %q, want %q", route, tc.route)
+			}
+		})
+	}
+}
+
+func TestDBSpansAreChildrenOfServerSpan(t *testing.T) {
+	api := newTestAPI(t)
+	spans := recordSpans(t)
+
+	res := api.do(http.MethodGet, "/api/chirps", "", nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/chirps: status %d", res.StatusCode)
+	}
+
+	recorded := spans()
+	server := serverSpan(t, recorded)
+	by_id := make(map[trace.SpanID]tracetest.SpanStub)
+	for _, span := range recorded {
+		by_id[span.SpanContext.SpanID()] = span
+	}
+
+	found := map[string]bool{}
+	for _, span := range recorded {
+		if span.Name != "DB.GetChirps" && span.Name != "DB.loadDB" {
+			continue
+		}
+		found[span.Name] = true
+
+		if span.SpanContext.TraceID() != server.SpanContext.TraceID() {
+			t.Fatalf("%s is in trace %s, want %s", span.Name, span.SpanContext.TraceID(), server.SpanContext.TraceID())
+		}
+		// Walk up to the server span
+		parent, ok := by_id[span.Parent.SpanID()]
+		for ok && parent.SpanKind != trace.SpanKindServer {
+			parent, ok = by_id[parent.Parent.SpanID()]
+		}
+		if !ok || parent.SpanContext.SpanID() != server.SpanContext.SpanID() {
+			t.Fatalf("%s doesn't descend from the server span", span.Name)
+		}
+	}
+	if !found["DB.GetChirps"] || !found["DB.loadDB"] {
+		t.Fatalf("got DB spans %v, want DB.GetChirps and DB.loadDB", found)
+	}
+}
+
+func TestServerSpanContinuesTraceparent(t *testing.T) {
+	api := newTestAPI(t)
+	spans := recordSpans(t)
+
+	const (
+		trace_id = "4bf92f3577b34da6a3ce929d0e0e4736"
+		span_id  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/api/chirps", nil)
+	req.Header.Set("traceparent", "00-"+trace_id+"-"+span_id+"-01")
+	api.handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	span := serverSpan(t, spans())
+	if got := span.SpanContext.TraceID().String(); got != trace_id {
+		t.Fatalf("trace id = %s, want the caller's %s", got, trace_id)
+	}
+	if got := span.Parent.SpanID().String(); got != span_id || !span.Parent.IsRemote() {
+		t.Fatalf("parent = %s (remote %t), want the caller's span %s", got, span.Parent.IsRemote(), span_id)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/secretbox"
+	"github.com/Hien-Trinh/chirpy/internal/token"
+	"github.com/Hien-Trinh/chirpy/internal/totp"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	recoveryCodeCount = 10
+
+	// Reasons a second factor is refused, as recorded with failed logins
+	reasonWrongTOTPCode     = "wrong_totp_code"
+	reasonWrongRecoveryCode = "wrong_recovery_code"
+)
+
+// handlerTOTPEnrollPost starts TOTP enrollment for the authenticated user.
+// The secret isn't enforced until it is confirmed with a code.
+func (a *apiConfig) handlerTOTPEnrollPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	if a.totpKey == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Two-factor authentication is not configured")
+		return
+	}
+
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create secret: %s", err))
+		return
+	}
+
+	encrypted_secret, err := secretbox.Seal(a.totpKey, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't encrypt secret: %s", err))
+		return
+	}
+
+	_, err = a.db.SetUserTOTPSecret(r.Context(), user.Id, encrypted_secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// handlerTOTPConfirmPost enables two-factor authentication once the user
+// proves their authenticator works, and returns one-time recovery codes
+func (a *apiConfig) handlerTOTPConfirmPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "No two-factor enrollment in progress")
+		return
+	}
+
+	secret, err := secretbox.Open(a.totpKey, user.TOTPSecret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't decrypt secret: %s", err))
+		return
+	}
+
+	step, ok := totp.Validate(secret, params.Code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Incorrect code")
+		return
+	}
+
+	recovery_codes, recovery_code_hashes, err := generateRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create recovery codes: %s", err))
+		return
+	}
+
+	_, err = a.db.EnableUserTOTP(r.Context(), user.Id, step, recovery_code_hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: recovery_codes,
+	})
+}
+
+// handlerTOTPDelete turns off two-factor authentication after checking
+// the user's password and, once enabled, a TOTP code or a recovery code
+func (a *apiConfig) handlerTOTPDelete(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	type parameters struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if user.TOTPEnabled && (params.Code == "") == (params.RecoveryCode == "") {
+		respondWithError(w, http.StatusBadRequest, "Exactly one of code and recovery code is required")
+		return
+	}
+
+	if !a.passwordMatches(r.Context(), user, params.Password) {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+
+	if user.TOTPEnabled {
+		retry_after, err := a.reserveLoginAttempt(r, user.Email)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't check login attempts: %s", err))
+			return
+		}
+		if retry_after > 0 {
+			respondWithLoginThrottled(w, retry_after)
+			return
+		}
+
+		reason, err := a.useSecondFactor(r.Context(), user, params.Code, params.RecoveryCode)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't check code: %s", err))
+			return
+		}
+		if reason != "" {
+			a.respondWithFailedTwoFactor(w, r, user, reason)
+			return
+		}
+
+		err = a.releaseLoginAttempt(r, user.Email)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't release login attempt: %s", err))
+			return
+		}
+	}
+
+	_, err = a.db.DisableUserTOTP(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// handlerLoginTwoFactorPost finishes a login started by handlerLoginPost
+// with either a TOTP code or a recovery code
+func (a *apiConfig) handlerLoginTwoFactorPost(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if (params.Code == "") == (params.RecoveryCode == "") {
+		respondWithError(w, http.StatusBadRequest, "Exactly one of code and recovery code is required")
+		return
+	}
+
+	user_id, err := a.tokens.ValidateChallenge(params.ChallengeToken)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Invalid challenge token: %s", err))
+		return
+	}
+
+	user, err := a.db.GetUserById(r.Context(), user_id)
+	if err != nil || !user.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "Invalid challenge token")
+		return
+	}
+
+	retry_after, err := a.reserveLoginAttempt(r, user.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't check login attempts: %s", err))
+		return
+	}
+	if retry_after > 0 {
+		respondWithLoginThrottled(w, retry_after)
+		return
+	}
+
+	reason, err := a.useSecondFactor(r.Context(), user, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't check code: %s", err))
+		return
+	}
+	if reason != "" {
+		a.respondWithFailedTwoFactor(w, r, user, reason)
+		return
+	}
+
+	err = a.releaseLoginAttempt(r, user.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't release login attempt: %s", err))
+		return
+	}
+
+	a.respondWithSession(w, r, user)
+}
+
+// useSecondFactor checks a TOTP code, or a recovery code when code is
+// empty, and uses it up so it can't be presented again. It returns the
+// reason the factor was refused, or an empty string if it was accepted.
+func (a *apiConfig) useSecondFactor(ctx context.Context, user database.User, code, recovery_code string) (string, error) {
+	if code == "" {
+		err := a.db.ConsumeUserRecoveryCode(ctx, user.Id, hashRecoveryCode(recovery_code))
+		if err != nil {
+			return reasonWrongRecoveryCode, nil
+		}
+		return "", nil
+	}
+
+	secret, err := secretbox.Open(a.totpKey, user.TOTPSecret)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decrypt secret: %s", err)
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return reasonWrongTOTPCode, nil
+	}
+
+	err = a.db.UseUserTOTPStep(ctx, user.Id, step)
+	if err != nil {
+		return reasonWrongTOTPCode, nil
+	}
+
+	return "", nil
+}
+
+// respondWithFailedTwoFactor records a failed second factor against
+// the account so codes can't be guessed faster than passwords
+func (a *apiConfig) respondWithFailedTwoFactor(w http.ResponseWriter, r *http.Request, user database.User, reason string) {
+	err := a.recordFailedLogin(r, user.Email, user.Id, reason)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't record login attempt: %s", err))
+		return
+	}
+
+	msg := "Incorrect code"
+	if reason == reasonWrongRecoveryCode {
+		msg = "Incorrect recovery code"
+	}
+	respondWithError(w, http.StatusUnauthorized, msg)
+}
+
+// generateRecoveryCodes returns new recovery codes along with the digests to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	recovery_codes := make([]string, 0, recoveryCodeCount)
+	recovery_code_hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		recovery_codes = append(recovery_codes, code)
+		recovery_code_hashes = append(recovery_code_hashes, hashRecoveryCode(code))
+	}
+
+	return recovery_codes, recovery_code_hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes so codes can be typed loosely
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	return token.Hash(code)
+}
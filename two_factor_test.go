@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/totp"
+)
+
+// enableTOTP enrolls and confirms an authenticator through the API and
+// returns its secret, the step of the code that confirmed it, and the
+// recovery codes
+func (api *testAPI) enableTOTP(token string) (string, int64, []string) {
+	api.t.Helper()
+
+	enrollment := struct {
+		Secret string `json:"secret"`
+	}{}
+	res := api.do(http.MethodPost, "/api/users/me/2fa/totp", token, nil, &enrollment)
+	if res.StatusCode != http.StatusOK {
+		api.t.Fatalf("enrolling: status %d", res.StatusCode)
+	}
+
+	step := totp.Step(time.Now())
+	code, err := totp.Code(enrollment.Secret, step)
+	if err != nil {
+		api.t.Fatalf("Code: %v", err)
+	}
+
+	confirmation := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	res = api.do(http.MethodPost, "/api/users/me/2fa/totp/confirm", token, map[string]string{"code": code}, &confirmation)
+	if res.StatusCode != http.StatusOK {
+		api.t.Fatalf("confirming: status %d", res.StatusCode)
+	}
+
+	return enrollment.Secret, step, confirmation.RecoveryCodes
+}
+
+func TestTOTPRecoveryCodeWorksOnce(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+	_, _, recovery_codes := api.enableTOTP(api.login("user@example.com", testPassword).Token)
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		login := api.login("user@example.com", testPassword)
+		if !login.TwoFactorRequired {
+			t.Fatal("login didn't ask for a second factor")
+		}
+
+		res := api.do(http.MethodPost, "/api/login/2fa", "", map[string]string{
+			"challenge_token": login.ChallengeToken,
+			"recovery_code":   recovery_codes[0],
+		}, nil)
+		if res.StatusCode != want {
+			t.Fatalf("use %d of the recovery code: status %d, want %d", i+1, res.StatusCode, want)
+		}
+	}
+}
+
+func TestTOTPDeleteRequiresSecondFactor(t *testing.T) {
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+	token := api.login("user@example.com", testPassword).Token
+	secret, step, recovery_codes := api.enableTOTP(token)
+
+	// The confirming code is used up, so the next step's code is the fresh one
+	code, err := totp.Code(secret, step+1)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		body map[string]string
+		want int
+	}{
+		{"password only", map[string]string{"password": testPassword}, http.StatusBadRequest},
+		{"code and recovery code", map[string]string{"password": testPassword, "code": code, "recovery_code": recovery_codes[0]}, http.StatusBadRequest},
+		{"wrong password", map[string]string{"password": "wrong password", "code": code}, http.StatusUnauthorized},
+		{"wrong code", map[string]string{"password": testPassword, "code": "000000"}, http.StatusUnauthorized},
+		{"wrong recovery code", map[string]string{"password": testPassword, "recovery_code": "aaaa-aaaa"}, http.StatusUnauthorized},
+		{"password and code", map[string]string{"password": testPassword, "code": code}, http.StatusNoContent},
+	}
+
+	for _, tc := range tests {
+		res := api.do(http.MethodDelete, "/api/users/me/2fa/totp", token, tc.body, nil)
+		if res.StatusCode != tc.want {
+			t.Fatalf("%s: status %d, want %d", tc.name, res.StatusCode, tc.want)
+		}
+	}
+
+	user, err = api.cfg.db.GetUserById(context.Background(), user.Id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if user.TOTPEnabled || user.TOTPSecret != "" {
+		t.Fatal("two-factor authentication is still enabled")
+	}
+}
+
+func TestTOTPDeleteWithRecoveryCode(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("user@example.com")
+	token := api.login("user@example.com", testPassword).Token
+	_, _, recovery_codes := api.enableTOTP(token)
+
+	res := api.do(http.MethodDelete, "/api/users/me/2fa/totp", token, map[string]string{
+		"password":      testPassword,
+		"recovery_code": recovery_codes[0],
+	}, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+}
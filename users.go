@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/Hien-Trinh/chirpy/internal/auth"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/logging"
 )
 
 func (a *apiConfig) handlerUsersPost(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -29,93 +32,168 @@ func (a *apiConfig) handlerUsersPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := a.db.GetUsers()
+	err = validateHandle(params.Handle)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get users: %s", err))
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid profile: %s", err))
 		return
 	}
 
-	for _, user := range users {
-		if user.Email == params.Email {
-			respondWithError(w, http.StatusBadRequest, "User already exists")
-			return
-		}
+	if !a.checkPassword(w, params.Password) {
+		return
 	}
 
-	hashed_password := passwordHash(params.Password)
+	hashed_password, err := a.passwordHash(r.Context(), params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't hash password: %s", err))
+		return
+	}
 
-	user, err := a.db.CreateUser(params.Email, hashed_password)
+	user, err := a.db.CreateUser(r.Context(), params.Email, hashed_password, params.Handle)
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithError(w, http.StatusBadRequest, "User already exists")
+		return
+	}
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, http.StatusConflict, "Handle is already taken")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create user: %s", err))
 		return
 	}
 
-	user_without_password := struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
-	}{
-		Id:          user.Id,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+	err = a.sendEmailVerification(r.Context(), user)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Couldn't send verification email", "error", err)
 	}
 
-	respondWithJSON(w, 201, user_without_password)
+	respondWithJSON(w, 201, newPrivateUser(user))
 }
 
-func (a *apiConfig) handlerUsersPut(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+// handlerUsersMeEmailPut changes the email of the authenticated user
+// after checking their current password
+func (a *apiConfig) handlerUsersMeEmailPut(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
 
-	user, err := auth.GetUserByJWT(a.db, a.jwtSecret, token)
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		NewEmail        string `json:"new_email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Couldn't get user: %s", err))
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if params.CurrentPassword == "" || params.NewEmail == "" {
+		respondWithError(w, http.StatusBadRequest, "Current password and new email are required")
+		return
+	}
+
+	if !a.passwordMatches(r.Context(), user, params.CurrentPassword) {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
 		return
 	}
 
+	user_updated, err := a.db.UpdateUserEmail(r.Context(), user.Id, params.NewEmail)
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithError(w, http.StatusConflict, "Email is already in use")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	err = a.sendEmailVerification(r.Context(), user_updated)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Couldn't send verification email", "error", err)
+	}
+
+	respondWithJSON(w, http.StatusOK, newPrivateUser(user_updated))
+}
+
+// handlerUsersMePasswordPut changes the password of the authenticated user
+// after checking their current password, and logs out every session
+func (a *apiConfig) handlerUsersMePasswordPut(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
 
-	if params.Email == "" || params.Password == "" {
-		respondWithError(w, http.StatusBadRequest, "Email and password are required")
+	if params.CurrentPassword == "" || params.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "Current password and new password are required")
 		return
 	}
 
-	hashed_password := passwordHash(params.Password)
+	if !a.passwordMatches(r.Context(), user, params.CurrentPassword) {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
 
-	user_updated, err := a.db.UpdateUserCredentials(user.Id, params.Email, hashed_password)
+	if !a.checkPassword(w, params.NewPassword) {
+		return
+	}
+
+	hashed_password, err := a.passwordHash(r.Context(), params.NewPassword)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't hash password: %s", err))
 		return
 	}
 
-	user_without_password := struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
-	}{
-		Id:          user_updated.Id,
-		Email:       user_updated.Email,
-		IsChirpyRed: user_updated.IsChirpyRed,
+	user_updated, err := a.db.ChangeUserPassword(r.Context(), user.Id, hashed_password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
 	}
 
-	respondWithJSON(w, 200, user_without_password)
+	respondWithJSON(w, http.StatusOK, newPrivateUser(user_updated))
 }
 
-func passwordHash(password string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		panic(err)
+// privateUser is the view of a user shown to the user themselves
+type privateUser struct {
+	Id            int           `json:"id"`
+	Email         string        `json:"email"`
+	EmailVerified bool          `json:"email_verified"`
+	IsChirpyRed   bool          `json:"is_chirpy_red"`
+	Role          database.Role `json:"role"`
+	Handle        string        `json:"handle"`
+	TOTPEnabled   bool          `json:"totp_enabled"`
+}
+
+func newPrivateUser(user database.User) privateUser {
+	return privateUser{
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		IsChirpyRed:   user.IsChirpyRed,
+		Role:          user.Role,
+		Handle:        user.Handle,
+		TOTPEnabled:   user.TOTPEnabled,
 	}
+}
+
+// passwordHash hashes a new password for storage
+func (a *apiConfig) passwordHash(ctx context.Context, password string) (string, error) {
+	return a.passwordHasher.Hash(ctx, password)
+}
 
-	return string(hash)
+// passwordMatches reports whether password is the user's password.
+// Users without a password never match.
+func (a *apiConfig) passwordMatches(ctx context.Context, user database.User, password string) bool {
+	ok, err := a.passwordHasher.Verify(ctx, password, user.Password)
+	return err == nil && ok
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/signature"
+)
+
+// upgrade grants a user Chirpy Red through a signed Polka webhook
+func (api *testAPI) upgrade(user_id int) {
+	api.t.Helper()
+
+	status := api.sendPolkaEvent(map[string]interface{}{
+		"id":    fmt.Sprintf("evt_upgrade_%d", user_id),
+		"event": "user.upgraded",
+		"data":  map[string]int{"user_id": user_id},
+	}, "")
+	if status != http.StatusNoContent {
+		api.t.Fatalf("upgrading user %d: status %d", user_id, status)
+	}
+}
+
+// sendPolkaEvent sends a signed Polka webhook, with a Polka-Event-Id
+// header unless header_id is empty, and returns the response status
+func (api *testAPI) sendPolkaEvent(event map[string]interface{}, header_id string) int {
+	api.t.Helper()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		api.t.Fatalf("encoding webhook: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", bytes.NewReader(body))
+	req.Header.Set("Authorization", "ApiKey "+api.cfg.polkaApiKey)
+	req.Header.Set("Polka-Signature", signature.Sign(api.cfg.polkaWebhookSecret, body, time.Now()))
+	if header_id != "" {
+		req.Header.Set("Polka-Event-Id", header_id)
+	}
+	rec := httptest.NewRecorder()
+	api.handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPolkaWebhookRequiresEventId(t *testing.T) {
+	api := newTestAPI(t)
+	user := api.createUser("user@example.com")
+
+	upgrade := map[string]interface{}{
+		"event": "user.upgraded",
+		"data":  map[string]int{"user_id": user.Id},
+	}
+	if status := api.sendPolkaEvent(upgrade, ""); status != http.StatusBadRequest {
+		t.Fatalf("event without an id: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if login := api.login(user.Email, testPassword); login.IsChirpyRed {
+		t.Fatal("event without an id upgraded the user")
+	}
+
+	// The header stands in for a missing id, and dedups the same way
+	for i := 0; i < 2; i++ {
+		if status := api.sendPolkaEvent(upgrade, "evt_header"); status != http.StatusNoContent {
+			t.Fatalf("event with a header id, attempt %d: status %d, want %d", i+1, status, http.StatusNoContent)
+		}
+	}
+	events, err := api.cfg.db.GetWebhookEvents(context.Background(), polkaSource, 10)
+	if err != nil {
+		t.Fatalf("GetWebhookEvents: %v", err)
+	}
+	if len(events) != 1 || events[0].EventId != "evt_header" {
+		t.Fatalf("events = %+v, want only evt_header", events)
+	}
+	if login := api.login(user.Email, testPassword); !login.IsChirpyRed {
+		t.Fatal("event with a header id didn't upgrade the user")
+	}
+}
+
+func TestCredentialChangesKeepChirpyRed(t *testing.T) {
+	const new_password = "battery staple"
+
+	tests := []struct {
+		name  string
+		path  string
+		body  map[string]string
+		email string
+		pass  string
+	}{
+		{
+			name:  "email",
+			path:  "/api/users/me/email",
+			body:  map[string]string{"current_password": testPassword, "new_email": "new@example.com"},
+			email: "new@example.com",
+			pass:  testPassword,
+		},
+		{
+			name:  "password",
+			path:  "/api/users/me/password",
+			body:  map[string]string{"current_password": testPassword, "new_password": new_password},
+			email: "user@example.com",
+			pass:  new_password,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			user := api.createUser("user@example.com")
+			api.upgrade(user.Id)
+
+			login := api.login("user@example.com", testPassword)
+			if !login.IsChirpyRed {
+				t.Fatal("user isn't Chirpy Red after the upgrade")
+			}
+
+			updated := privateUser{}
+			res := api.do(http.MethodPut, tc.path, login.Token, tc.body, &updated)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("PUT %s: status %d", tc.path, res.StatusCode)
+			}
+			if !updated.IsChirpyRed {
+				t.Fatalf("PUT %s response dropped Chirpy Red", tc.path)
+			}
+
+			login = api.login(tc.email, tc.pass)
+			if !login.IsChirpyRed {
+				t.Fatalf("user lost Chirpy Red after PUT %s", tc.path)
+			}
+		})
+	}
+}
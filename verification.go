@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/logging"
+	"github.com/Hien-Trinh/chirpy/internal/mailer"
+	"github.com/Hien-Trinh/chirpy/internal/token"
+)
+
+const (
+	emailVerificationExpiry = time.Hour * 24
+	passwordResetExpiry     = time.Hour
+)
+
+// sendEmailVerification emails a new verification token to the current email of a user
+func (a *apiConfig) sendEmailVerification(ctx context.Context, user database.User) error {
+	verification_token, err := token.Generate()
+	if err != nil {
+		return err
+	}
+
+	_, err = a.db.CreateUserToken(ctx, user.Id, database.UserTokenEmailVerification, user.Email, token.Hash(verification_token), time.Now().Add(emailVerificationExpiry).UTC())
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email",
+		Body:    fmt.Sprintf("Use this token to verify your email address:\n\n%s\n\nIt expires in 24 hours.", verification_token),
+	})
+}
+
+// handlerVerifyEmailRequestPost sends a new verification email to the authenticated user
+func (a *apiConfig) handlerVerifyEmailRequestPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email is already verified")
+		return
+	}
+
+	err := a.sendEmailVerification(r.Context(), user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't send verification email: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// handlerVerifyEmailConfirmPost marks an email as verified using a token from a verification email
+func (a *apiConfig) handlerVerifyEmailConfirmPost(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	user_token, err := a.db.ConsumeUserToken(r.Context(), database.UserTokenEmailVerification, token.Hash(params.Token))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid token: %s", err))
+		return
+	}
+
+	user, err := a.db.VerifyUserEmail(r.Context(), user_token.UserID, user_token.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't verify email: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newPrivateUser(user))
+}
+
+// handlerPasswordResetRequestPost emails a password reset token.
+// It responds the same way whether or not the email belongs to a user.
+func (a *apiConfig) handlerPasswordResetRequestPost(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if params.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	user, err := a.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil {
+		respondWithJSON(w, http.StatusNoContent, nil)
+		return
+	}
+
+	reset_token, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
+		return
+	}
+
+	_, err = a.db.CreateUserToken(r.Context(), user.Id, database.UserTokenPasswordReset, user.Email, token.Hash(reset_token), time.Now().Add(passwordResetExpiry).UTC())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create token: %s", err))
+		return
+	}
+
+	err = a.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    fmt.Sprintf("Use this token to choose a new password:\n\n%s\n\nIt expires in 1 hour. If you didn't ask for a reset, you can ignore this email.", reset_token),
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Couldn't send password reset email", "error", err)
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// handlerPasswordResetConfirmPost sets a new password using a token from a reset email
+// and logs out every session
+func (a *apiConfig) handlerPasswordResetConfirmPost(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	if params.Token == "" || params.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "Token and new password are required")
+		return
+	}
+
+	// Checked before the token is consumed so the user can try another password
+	if !a.checkPassword(w, params.NewPassword) {
+		return
+	}
+
+	user_token, err := a.db.ConsumeUserToken(r.Context(), database.UserTokenPasswordReset, token.Hash(params.Token))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid token: %s", err))
+		return
+	}
+
+	hashed_password, err := a.passwordHash(r.Context(), params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't hash password: %s", err))
+		return
+	}
+
+	_, err = a.db.ChangeUserPassword(r.Context(), user_token.UserID, hashed_password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't update user: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Hien-Trinh/chirpy/internal/auth"
+	"github.com/Hien-Trinh/chirpy/internal/database"
+	"github.com/Hien-Trinh/chirpy/internal/logging"
+	"github.com/Hien-Trinh/chirpy/internal/token"
+	"github.com/Hien-Trinh/chirpy/internal/webhooks"
+)
+
+const maxWebhookEndpoints = 10
+
+type webhookEndpoint struct {
+	Id        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookEndpoint(endpoint database.WebhookEndpoint) webhookEndpoint {
+	return webhookEndpoint{
+		Id:        endpoint.Id,
+		URL:       endpoint.URL,
+		Events:    endpoint.Events,
+		CreatedAt: endpoint.CreatedAt,
+	}
+}
+
+// handlerWebhooksPost registers a webhook endpoint for the authenticated user.
+// The signing secret is only ever shown in this response.
+func (a *apiConfig) handlerWebhooksPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	endpoint_url, err := url.Parse(params.URL)
+	if err != nil || (endpoint_url.Scheme != "https" && endpoint_url.Scheme != "http") || endpoint_url.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "URL must be an absolute http or https URL")
+		return
+	}
+	if len(params.Events) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one event is required")
+		return
+	}
+	for _, event := range params.Events {
+		if !webhooks.ValidEvent(event) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown event %q", event))
+			return
+		}
+	}
+
+	endpoints, err := a.db.GetWebhookEndpointsByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get webhooks: %s", err))
+		return
+	}
+	if len(endpoints) >= maxWebhookEndpoints {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("You can have at most %d webhooks", maxWebhookEndpoints))
+		return
+	}
+
+	secret, err := token.Generate()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create secret: %s", err))
+		return
+	}
+	secret = "whsec_" + secret
+
+	endpoint, err := a.db.CreateWebhookEndpoint(r.Context(), user.Id, endpoint_url.String(), secret, params.Events)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't create webhook: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, struct {
+		webhookEndpoint
+		Secret string `json:"secret"`
+	}{
+		webhookEndpoint: newWebhookEndpoint(endpoint),
+		Secret:          secret,
+	})
+}
+
+// handlerWebhooksGet lists the webhook endpoints of the authenticated user
+func (a *apiConfig) handlerWebhooksGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	endpoints, err := a.db.GetWebhookEndpointsByUser(r.Context(), user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get webhooks: %s", err))
+		return
+	}
+
+	response := make([]webhookEndpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		response = append(response, newWebhookEndpoint(endpoint))
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handlerWebhooksDeleteById deletes a webhook endpoint and its pending deliveries
+func (a *apiConfig) handlerWebhooksDeleteById(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := a.ownWebhookEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.db.DeleteWebhookEndpoint(r.Context(), endpoint.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't delete webhook: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// handlerWebhookDeliveriesGet lists the most recent deliveries to a webhook endpoint
+func (a *apiConfig) handlerWebhookDeliveriesGet(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := a.ownWebhookEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 100
+	if limit_string := r.URL.Query().Get("limit"); limit_string != "" {
+		parsed, err := strconv.Atoi(limit_string)
+		if err != nil || parsed < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	deliveries, err := a.db.GetWebhookDeliveriesByEndpoint(r.Context(), endpoint.Id, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't get deliveries: %s", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// handlerWebhookDeliveryRetryPost queues a dead-lettered delivery again
+func (a *apiConfig) handlerWebhookDeliveryRetryPost(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := a.ownWebhookEndpoint(w, r)
+	if !ok {
+		return
+	}
+
+	delivery_id, err := strconv.Atoi(r.PathValue("delivery_id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return
+	}
+
+	delivery, err := a.db.RetryWebhookDelivery(r.Context(), endpoint.Id, delivery_id)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't retry delivery: %s", err))
+		return
+	}
+	a.webhooks.Notify()
+
+	respondWithJSON(w, http.StatusAccepted, delivery)
+}
+
+// ownWebhookEndpoint loads the webhook endpoint named in the path,
+// responding 404 unless it belongs to the authenticated user
+func (a *apiConfig) ownWebhookEndpoint(w http.ResponseWriter, r *http.Request) (database.WebhookEndpoint, bool) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ID: %s", err))
+		return database.WebhookEndpoint{}, false
+	}
+
+	endpoint, err := a.db.GetWebhookEndpoint(r.Context(), id)
+	if err != nil || endpoint.UserID != user.Id {
+		respondWithError(w, http.StatusNotFound, "Webhook not found")
+		return database.WebhookEndpoint{}, false
+	}
+
+	return endpoint, true
+}
+
+// emitWebhookEvent queues event about user_id for every subscribed endpoint.
+// Failing to queue never fails the request that caused the event.
+func (a *apiConfig) emitWebhookEvent(ctx context.Context, event string, user_id int, data interface{}) {
+	err := a.queueWebhookEvent(ctx, event, user_id, data)
+	if err != nil {
+		logging.FromContext(ctx).Error("Couldn't queue webhooks", "event", event, "error", err)
+	}
+}
+
+// queueWebhookEvent queues event about user_id for every subscribed endpoint
+func (a *apiConfig) queueWebhookEvent(ctx context.Context, event string, user_id int, data interface{}) error {
+	event_id, err := token.Generate()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(struct {
+		Id        string      `json:"id"`
+		Event     string      `json:"event"`
+		CreatedAt time.Time   `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{
+		Id:        "evt_" + event_id[:24],
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	queued, err := a.db.EnqueueWebhookEvent(ctx, event, user_id, string(payload))
+	if err != nil {
+		return err
+	}
+	if queued > 0 {
+		a.webhooks.Notify()
+	}
+	return nil
+}